@@ -0,0 +1,29 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import "time"
+
+// Clock is used by Hupd to wait for timeouts. It allows tests to trigger timeouts without waiting
+// for real time to pass.
+type Clock interface {
+	// After returns a channel that receives the current time once d has elapsed, as time.After
+	// does.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is a Clock that uses the time package.
+type realClock struct{}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (h *Hupd) clock() Clock {
+	if h.Clock == nil {
+		return realClock{}
+	}
+	return h.Clock
+}
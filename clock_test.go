@@ -0,0 +1,94 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose timeouts only elapse when fire is called.
+type fakeClock struct {
+	waits chan time.Duration
+	fired chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan time.Duration, 10), fired: make(chan time.Time)}
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.waits <- d
+	return c.fired
+}
+
+// fire waits for something to wait on the clock and then makes its timeout elapse.
+func (c *fakeClock) fire(t *testing.T) time.Duration {
+	t.Helper()
+	select {
+	case d := <-c.waits:
+		c.fired <- time.Now()
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing waited on the clock")
+		return 0
+	}
+}
+
+// blockingProcess is a Process whose BeginRestart method blocks until release is closed.
+type blockingProcess struct {
+	release chan struct{}
+	killed  bool
+}
+
+func (p *blockingProcess) BeginRestart(*exec.Cmd) error {
+	<-p.release
+	return nil
+}
+
+func (p *blockingProcess) Kill() { p.killed = true }
+
+func TestBeginRestartTimeoutUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	p := &blockingProcess{release: make(chan struct{})}
+	defer close(p.release)
+	h := &Hupd{Process: p, Timeout: time.Hour, Clock: clock}
+
+	errc := make(chan error, 1)
+	go func() { errc <- h.Restart() }()
+
+	if d := clock.fire(t); d != time.Hour {
+		t.Errorf("waited for %v; want %v", d, time.Hour)
+	}
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrTimeoutSentinel) {
+			t.Errorf("Restart() error = %v; want an ErrTimeout error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Restart didn't return after the timeout elapsed")
+	}
+	if p.killed {
+		t.Error("Kill was called after a failed restart")
+	}
+}
+
+func TestCoalesceUsesClock(t *testing.T) {
+	clock := newFakeClock()
+	h := &Hupd{CoalesceWindow: time.Minute, Clock: clock}
+
+	errc := make(chan error, 1)
+	go func() { errc <- h.coalesce(nil, nil) }()
+
+	if d := clock.fire(t); d != time.Minute {
+		t.Errorf("waited for %v; want %v", d, time.Minute)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("coalesce() error = %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// controlIOTimeout bounds how long NotifyRestartSocket waits to read a command from a connection.
+const controlIOTimeout = 10 * time.Second
+
+// nextArgsKey is the context key used to pass the arguments given to a restart command to restart.
+type nextArgsKey struct{}
+
+// nextArgs returns the arguments passed to a restart command, if any, stored in ctx.
+func nextArgs(ctx context.Context) []string {
+	args, _ := ctx.Value(nextArgsKey{}).([]string)
+	return args
+}
+
+// NotifyRestartSocket listens on a Unix domain socket at path for restart commands, as an
+// alternative to restart signals. Each connection sends a single line, which may be:
+//
+//	restart
+//	restart arg...
+//
+// The first restarts the process as NotifyRestart does. The second restarts it with the given
+// arguments (separated by spaces) in place of those following the program name, as if they were
+// set in NextArgs. NotifyRestartSocket replies with "restarting" once a restart begins, followed
+// by "error: " and the error if it fails, or "ok" if it succeeds (though the Process's Kill method
+// normally exits the program first). Unknown commands are answered with an error.
+//
+// The socket is only accessible to this user, including while it's being created. Any existing
+// socket at path is replaced; if path exists and isn't a socket, an ErrListen error is returned.
+// The socket is closed while a restart is in progress, so that the new process can listen on the
+// same path, and is reopened if the restart fails.
+//
+// NotifyRestartSocket returns nil once a restart succeeds. If a restart fails, it keeps listening
+// for commands. If the Hupd is stopped, it returns an ErrStopped error. If it can't listen on
+// path, it returns an ErrListen error.
+func (h *Hupd) NotifyRestartSocket(path string) error {
+	for {
+		l, err := listenControl(path)
+		if err != nil {
+			return err
+		}
+
+		conn, args, err := h.acceptRestart(l)
+		l.Close()
+		if err != nil {
+			return err
+		}
+
+		ctx := context.Background()
+		if args != nil {
+			ctx = context.WithValue(ctx, nextArgsKey{}, args)
+		}
+
+		fmt.Fprintln(conn, "restarting")
+		err = h.RestartContext(ctx)
+		if err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		} else {
+			fmt.Fprintln(conn, "ok")
+		}
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+// listenControl listens on a Unix domain socket at path, replacing any existing socket there.
+//
+// The socket is created in a temporary directory accessible only to this user and restricted to
+// this user before it's moved to path, since a socket created at path directly would be open to
+// connections from other users until its permissions were changed.
+func listenControl(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, &Error{ErrListen, fmt.Errorf("%s exists and is not a socket", path)}
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".huprt-control-*")
+	if err != nil {
+		return nil, &Error{ErrListen, err}
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, &Error{ErrListen, err}
+	}
+	// The socket is moved, so the listener can't remove it on Close. controlListener does so
+	// instead.
+	l.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, 0600); err != nil {
+		l.Close()
+		return nil, &Error{ErrListen, err}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		l.Close()
+		return nil, &Error{ErrListen, err}
+	}
+	return &controlListener{l, path}, nil
+}
+
+// controlListener is a listener for NotifyRestartSocket that removes its socket when closed.
+type controlListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *controlListener) Close() error {
+	err := l.UnixListener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// acceptRestart accepts connections on l until one sends a restart command, returning the
+// connection and the command's arguments, if any. Other commands are answered with an error. If
+// the Hupd is stopped first, it returns an ErrStopped error.
+func (h *Hupd) acceptRestart(l net.Listener) (net.Conn, []string, error) {
+	done := h.done()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-done:
+			l.Close()
+		case <-closed:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if isDone(done) {
+				return nil, nil, &Error{ErrStopped, nil}
+			}
+			return nil, nil, &Error{ErrListen, err}
+		}
+
+		conn.SetReadDeadline(time.Now().Add(controlIOTimeout))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil && line == "" {
+			conn.Close()
+			continue
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "restart" {
+			fmt.Fprintf(conn, "error: unknown command %q\n", strings.TrimSpace(line))
+			conn.Close()
+			continue
+		}
+
+		var args []string
+		if len(fields) > 1 {
+			args = append([]string{os.Args[0]}, fields[1:]...)
+		}
+		return conn, args, nil
+	}
+}
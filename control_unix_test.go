@@ -0,0 +1,77 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenControl(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "control.sock")
+
+	// A stale socket from an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenControl(path)
+	if err != nil {
+		t.Fatalf("listenControl() error = %v", err)
+	}
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v; want a socket with mode 0600", fi.Mode())
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket still exists after Close: %v", err)
+	}
+
+	// Only the socket is left behind while listening, not the temporary directory.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("directory contains %d entries after Close; want 0", len(entries))
+	}
+}
+
+func TestListenControlNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	if err := os.WriteFile(path, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := listenControl(path); !errors.Is(err, ErrListenSentinel) {
+		t.Errorf("listenControl() error = %v; want an ErrListen error", err)
+	}
+	if b, err := os.ReadFile(path); err != nil || string(b) != "keep" {
+		t.Errorf("file was modified: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parentPIDEnvKey is the environment variable used to pass the old process's PID to the new
+// process.
+const parentPIDEnvKey = "HUPRT_PARENT_PID"
+
+// setEnv returns env with key set to value. Any existing entries for key are removed.
+func setEnv(env []string, key, value string) []string {
+	return append(unsetEnv(env, key), key+"="+value)
+}
+
+// unsetEnv returns env without any entries for key.
+func unsetEnv(env []string, key string) []string {
+	prefix := key + "="
+	out := env[:0:0]
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// setCmdEnv sets the environment variable key to value in cmd's environment. If cmd.Env is nil,
+// it is first initialized to this process's environment so that the new process still inherits it.
+func setCmdEnv(cmd *exec.Cmd, key, value string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = setEnv(cmd.Env, key, value)
+}
+
+// cmdEnv returns the value of the environment variable key in cmd's environment. If cmd.Env is
+// nil, this process's environment is used.
+func cmdEnv(cmd *exec.Cmd, key string) string {
+	if cmd.Env == nil {
+		return os.Getenv(key)
+	}
+
+	prefix := key + "="
+	value := ""
+	for _, kv := range cmd.Env {
+		// As with os/exec, the last value for a key takes precedence.
+		if strings.HasPrefix(kv, prefix) {
+			value = kv[len(prefix):]
+		}
+	}
+	return value
+}
+
+// envInt returns the integer value of the environment variable key. If the variable is unset or
+// not an integer, it returns 0.
+func envInt(key string) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// restartEnv returns the environment for a new process. This is the Hupd's Env, or this process's
+// environment if Env is nil, plus any variables set by huprt.
+func (h *Hupd) restartEnv() []string {
+	var env []string
+	if h.Env != nil {
+		env = make([]string, len(h.Env))
+		copy(env, h.Env)
+	} else {
+		env = filterEnv(os.Environ(), h.EnvAllow, h.EnvDeny)
+	}
+
+	// These are only set for the processes that need them, by the restart that starts them.
+	// Values inherited from this process's parent describe the previous restart, and would be
+	// stale in the new process.
+	env = unsetEnv(env, childIndexEnvKey)
+	env = unsetEnv(env, readyOnStartEnvKey)
+	env = unsetEnv(env, readyFDEnvKey)
+	env = unsetEnv(env, numFDsEnvKey)
+	env = unsetEnv(env, fdNamesEnvKey)
+	env = unsetEnv(env, stateFileEnvKey)
+
+	genKey := h.generationEnvKey()
+	gen := envInt(genKey) + 1
+	env = setEnv(env, genKey, strconv.Itoa(gen))
+	env = setEnv(env, parentPIDEnvKey, strconv.Itoa(os.Getpid()))
+
+	return env
+}
+
+// filterEnv returns the entries of env matched by allow, if it's not empty, and not matched by
+// deny. See the Hupd's EnvAllow and EnvDeny fields.
+func filterEnv(env, allow, deny []string) []string {
+	if len(allow) == 0 && len(deny) == 0 {
+		return env
+	}
+
+	out := env[:0:0]
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if len(allow) > 0 && !matchEnv(key, allow) {
+			continue
+		}
+		if matchEnv(key, deny) {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// matchEnv reports whether key is matched by any of patterns. A pattern ending in "*" matches any
+// key with the preceding prefix.
+func matchEnv(key string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestRestartEnvStripsStaleKeys(t *testing.T) {
+	t.Setenv(numFDsEnvKey, "2")
+	t.Setenv(fdNamesEnvKey, "http,admin")
+	t.Setenv(readyFDEnvKey, "5")
+	t.Setenv(stateFileEnvKey, "/tmp/huprt-state-stale")
+	t.Setenv(childIndexEnvKey, "1")
+	t.Setenv(readyOnStartEnvKey, "1")
+
+	h := &Hupd{}
+	env := h.restartEnv()
+	for _, key := range []string{
+		numFDsEnvKey, fdNamesEnvKey, readyFDEnvKey, stateFileEnvKey, childIndexEnvKey,
+		readyOnStartEnvKey,
+	} {
+		cmd := &exec.Cmd{Env: env}
+		if v := cmdEnv(cmd, key); v != "" {
+			t.Errorf("restartEnv() kept %s=%q from the parent", key, v)
+		}
+	}
+}
+
+func TestPassFileIgnoresInheritedNames(t *testing.T) {
+	t.Setenv(numFDsEnvKey, "2")
+	t.Setenv(fdNamesEnvKey, "http,admin")
+
+	h := &Hupd{}
+	cmd := &exec.Cmd{Env: h.restartEnv()}
+	cmd.ExtraFiles = append(cmd.ExtraFiles, os.Stdin)
+	fd, err := PassFile(cmd, "http", os.Stdin)
+	if err != nil {
+		t.Fatalf("PassFile() error = %v", err)
+	}
+	if fd != firstExtraFD+1 {
+		t.Errorf("PassFile() fd = %d; want %d", fd, firstExtraFD+1)
+	}
+
+	setFDEnv(cmd)
+	if got, want := cmdEnv(cmd, fdNamesEnvKey), ",http"; got != want {
+		t.Errorf("%s = %q; want %q", fdNamesEnvKey, got, want)
+	}
+	if got, want := cmdEnv(cmd, numFDsEnvKey), "2"; got != want {
+		t.Errorf("%s = %q; want %q", numFDsEnvKey, got, want)
+	}
+}
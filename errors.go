@@ -4,30 +4,223 @@
 
 package huprt
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
 // Error represents a huprt error. All errors returned by huprt all contain an
 // error code identifying where the error originated from as well as an
 // additional inner error that triggered this error.
 //
 // There are no un-wrapped errors returned by huprt.
 type Error struct {
-	Code  int
+	Code  Code
 	Inner error
 }
 
+// Code identifies where a huprt error originated. Codes defined by other packages should be
+// registered with RegisterErrorCode so that they have a message.
+type Code int
+
+// String returns the message for c, as returned by CodeString.
+func (c Code) String() string {
+	return CodeString(c)
+}
+
 const (
-	ErrTimeout     int = iota // huprt: process restart timed out
-	ErrNewProcess             // huprt: error starting new process
-	ErrKillProcess            // huprt: error killing parent process
-	ErrRestart                // huprt: restart error
-	ErrNoProcess              // huprt: Hupd.Process is nil
+	ErrTimeout           Code = iota // huprt: process restart timed out
+	ErrNewProcess                    // huprt: error starting new process
+	ErrKillProcess                   // huprt: error killing parent process
+	ErrRestart                       // huprt: restart error
+	ErrNoProcess                     // huprt: Hupd.Process is nil
+	ErrCanceled                      // huprt: restart canceled
+	ErrSignalConflict                // huprt: restart and kill signals are the same
+	ErrChildExited                   // huprt: new process exited before handshake
+	ErrPassFile                      // huprt: error passing file to new process
+	ErrInheritFile                   // huprt: error inheriting file from parent process
+	ErrReady                         // huprt: error signaling readiness
+	ErrRestartInProgress             // huprt: restart already in progress
+	ErrOrphaned                      // huprt: parent process is gone
+	ErrNotResumable                  // huprt: Process does not implement Resumable
+	ErrResume                        // huprt: error resuming process
+	ErrUnsupported                   // huprt: not supported on this platform
+	ErrListen                        // huprt: error creating listener
+	ErrCodeDefined                   // huprt: error code already defined
+	ErrPanic                         // huprt: Process panicked
+	ErrUnhealthy                     // huprt: new process failed health check
+	ErrTrigger                       // huprt: error triggering restart
+	ErrKill                          // huprt: error killing process
+	ErrStopped                       // huprt: Hupd stopped
+	ErrRestartArg                    // huprt: invalid restart argument
+	ErrState                         // huprt: error transferring state
+	ErrRateLimited                   // huprt: too many restarts
+	ErrPIDFile                       // huprt: error writing PID file
+	ErrReload                        // huprt: error reloading process
+)
+
+// Sentinel errors for each error code. These can be passed to errors.Is to test whether an error
+// returned by huprt has a given code, regardless of its inner error. For example:
+//
+//	if errors.Is(err, huprt.ErrTimeoutSentinel) {
+//		// Handle timeout
+//	}
+var (
+	ErrTimeoutSentinel           = &Error{Code: ErrTimeout}
+	ErrNewProcessSentinel        = &Error{Code: ErrNewProcess}
+	ErrKillProcessSentinel       = &Error{Code: ErrKillProcess}
+	ErrRestartSentinel           = &Error{Code: ErrRestart}
+	ErrNoProcessSentinel         = &Error{Code: ErrNoProcess}
+	ErrCanceledSentinel          = &Error{Code: ErrCanceled}
+	ErrSignalConflictSentinel    = &Error{Code: ErrSignalConflict}
+	ErrChildExitedSentinel       = &Error{Code: ErrChildExited}
+	ErrPassFileSentinel          = &Error{Code: ErrPassFile}
+	ErrInheritFileSentinel       = &Error{Code: ErrInheritFile}
+	ErrReadySentinel             = &Error{Code: ErrReady}
+	ErrRestartInProgressSentinel = &Error{Code: ErrRestartInProgress}
+	ErrOrphanedSentinel          = &Error{Code: ErrOrphaned}
+	ErrNotResumableSentinel      = &Error{Code: ErrNotResumable}
+	ErrResumeSentinel            = &Error{Code: ErrResume}
+	ErrUnsupportedSentinel       = &Error{Code: ErrUnsupported}
+	ErrListenSentinel            = &Error{Code: ErrListen}
+	ErrCodeDefinedSentinel       = &Error{Code: ErrCodeDefined}
+	ErrPanicSentinel             = &Error{Code: ErrPanic}
+	ErrUnhealthySentinel         = &Error{Code: ErrUnhealthy}
+	ErrTriggerSentinel           = &Error{Code: ErrTrigger}
+	ErrKillSentinel              = &Error{Code: ErrKill}
+	ErrStoppedSentinel           = &Error{Code: ErrStopped}
+	ErrRestartArgSentinel        = &Error{Code: ErrRestartArg}
+	ErrStateSentinel             = &Error{Code: ErrState}
+	ErrRateLimitedSentinel       = &Error{Code: ErrRateLimited}
+	ErrPIDFileSentinel           = &Error{Code: ErrPIDFile}
+	ErrReloadSentinel            = &Error{Code: ErrReload}
 )
 
-var errMessages = map[int]string{
-	ErrTimeout:     "huprt: process restart timed out",
-	ErrNewProcess:  "huprt: error starting new process",
-	ErrKillProcess: "huprt: error killing parent process",
-	ErrRestart:     "huprt: restart error",
-	ErrNoProcess:   "huprt: Hupd.Process is nil",
+var errMessages = map[Code]string{
+	ErrTimeout:           "huprt: process restart timed out",
+	ErrNewProcess:        "huprt: error starting new process",
+	ErrKillProcess:       "huprt: error killing parent process",
+	ErrRestart:           "huprt: restart error",
+	ErrNoProcess:         "huprt: Hupd.Process is nil",
+	ErrCanceled:          "huprt: restart canceled",
+	ErrSignalConflict:    "huprt: restart and kill signals are the same",
+	ErrChildExited:       "huprt: new process exited before handshake",
+	ErrPassFile:          "huprt: error passing file to new process",
+	ErrInheritFile:       "huprt: error inheriting file from parent process",
+	ErrReady:             "huprt: error signaling readiness",
+	ErrRestartInProgress: "huprt: restart already in progress",
+	ErrOrphaned:          "huprt: parent process is gone",
+	ErrNotResumable:      "huprt: Process does not implement Resumable",
+	ErrResume:            "huprt: error resuming process",
+	ErrUnsupported:       "huprt: not supported on this platform",
+	ErrListen:            "huprt: error creating listener",
+	ErrCodeDefined:       "huprt: error code already defined",
+	ErrPanic:             "huprt: Process panicked",
+	ErrUnhealthy:         "huprt: new process failed health check",
+	ErrTrigger:           "huprt: error triggering restart",
+	ErrKill:              "huprt: error killing process",
+	ErrStopped:           "huprt: Hupd stopped",
+	ErrRestartArg:        "huprt: invalid restart argument",
+	ErrState:             "huprt: error transferring state",
+	ErrRateLimited:       "huprt: too many restarts",
+	ErrPIDFile:           "huprt: error writing PID file",
+	ErrReload:            "huprt: error reloading process",
+}
+
+// ChildError is the inner error of an Error returned when a restart fails after the new process
+// was started but before it completed the handshake, such as when the restart times out or is
+// canceled. The new process may still be running, so PID identifies it, allowing the caller to
+// decide whether to kill it or keep it.
+type ChildError struct {
+	PID int
+	Err error
+}
+
+func (e *ChildError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("new process %d did not complete the handshake", e.PID)
+	}
+	return fmt.Sprintf("new process %d: %v", e.PID, e.Err)
+}
+
+// Unwrap returns the error that interrupted the handshake, if any.
+func (e *ChildError) Unwrap() error {
+	return e.Err
+}
+
+// codeNames holds the name of each error code defined by huprt, for MarshalJSON.
+var codeNames = map[Code]string{
+	ErrTimeout:           "ErrTimeout",
+	ErrNewProcess:        "ErrNewProcess",
+	ErrKillProcess:       "ErrKillProcess",
+	ErrRestart:           "ErrRestart",
+	ErrNoProcess:         "ErrNoProcess",
+	ErrCanceled:          "ErrCanceled",
+	ErrSignalConflict:    "ErrSignalConflict",
+	ErrChildExited:       "ErrChildExited",
+	ErrPassFile:          "ErrPassFile",
+	ErrInheritFile:       "ErrInheritFile",
+	ErrReady:             "ErrReady",
+	ErrRestartInProgress: "ErrRestartInProgress",
+	ErrOrphaned:          "ErrOrphaned",
+	ErrNotResumable:      "ErrNotResumable",
+	ErrResume:            "ErrResume",
+	ErrUnsupported:       "ErrUnsupported",
+	ErrListen:            "ErrListen",
+	ErrCodeDefined:       "ErrCodeDefined",
+	ErrPanic:             "ErrPanic",
+	ErrUnhealthy:         "ErrUnhealthy",
+	ErrTrigger:           "ErrTrigger",
+	ErrKill:              "ErrKill",
+	ErrStopped:           "ErrStopped",
+	ErrRestartArg:        "ErrRestartArg",
+	ErrState:             "ErrState",
+	ErrRateLimited:       "ErrRateLimited",
+	ErrPIDFile:           "ErrPIDFile",
+	ErrReload:            "ErrReload",
+}
+
+var (
+	customMessagesMu sync.RWMutex
+	customMessages   = map[Code]string{}
+)
+
+// RegisterErrorCode registers a message for a custom error code, allowing packages built on huprt
+// to return Errors with their own codes. If code is already defined, either by huprt or a previous
+// call to RegisterErrorCode, an ErrCodeDefined error is returned and the message is not changed.
+// It is safe to call RegisterErrorCode concurrently.
+func RegisterErrorCode(code Code, msg string) error {
+	customMessagesMu.Lock()
+	defer customMessagesMu.Unlock()
+
+	if _, ok := errMessages[code]; ok {
+		return &Error{ErrCodeDefined, fmt.Errorf("error code %d is defined by huprt", code)}
+	}
+	if _, ok := customMessages[code]; ok {
+		return &Error{ErrCodeDefined, fmt.Errorf("error code %d is already registered", code)}
+	}
+	customMessages[code] = msg
+	return nil
+}
+
+// CodeString returns the message for an error code, without any inner error. This is useful for
+// logging the stage of a restart that failed separately from the error that caused it. Codes
+// registered with RegisterErrorCode are included.
+func CodeString(code Code) string {
+	if msg, ok := errMessages[code]; ok {
+		return msg
+	}
+
+	customMessagesMu.RLock()
+	msg, ok := customMessages[code]
+	customMessagesMu.RUnlock()
+	if !ok {
+		return "huprt: unknown error"
+	}
+	return msg
 }
 
 func (e *Error) Error() string {
@@ -35,14 +228,78 @@ func (e *Error) Error() string {
 		return "huprt: no error"
 	}
 
-	msg, ok := errMessages[e.Code]
-	if !ok {
-		msg = "huprt: unknown error"
+	msg := CodeString(e.Code)
+	if e.Inner != nil {
+		// Drop the repeated prefix of a nested huprt error.
+		msg += ": " + strings.TrimPrefix(e.Inner.Error(), "huprt: ")
+	}
+
+	return msg
+}
+
+// Unwrap returns the inner error that triggered this error, if any.
+func (e *Error) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	return e.Inner
+}
+
+// MarshalJSON encodes e as a JSON object for structured logging, such as:
+//
+//	{"code": 0, "code_name": "ErrTimeout", "message": "huprt: process restart timed out: ...",
+//	 "cause": "..."}
+//
+// The code_name is empty for codes not defined by huprt, and cause is omitted if there's no inner
+// error. A nil *Error is encoded as null.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	if e == nil {
+		return []byte("null"), nil
 	}
 
+	v := struct {
+		Code     Code   `json:"code"`
+		CodeName string `json:"code_name"`
+		Message  string `json:"message"`
+		Cause    string `json:"cause,omitempty"`
+	}{
+		Code:     e.Code,
+		CodeName: codeNames[e.Code],
+		Message:  e.Error(),
+	}
 	if e.Inner != nil {
-		msg += ": " + e.Inner.Error()
+		v.Cause = e.Inner.Error()
 	}
+	return json.Marshal(v)
+}
 
-	return msg
+// Codes returns the codes of e and any huprt errors nested in its inner errors, outermost first.
+// For example, if a Process's BeginRestart method returns an ErrPassFile error, Restart returns an
+// ErrRestart error wrapping it, whose Codes are ErrRestart and then ErrPassFile.
+func (e *Error) Codes() []Code {
+	var codes []Code
+	var err error = e
+	for err != nil {
+		var he *Error
+		if !errors.As(err, &he) || he == nil {
+			break
+		}
+		codes = append(codes, he.Code)
+		err = he.Inner
+	}
+	return codes
+}
+
+// Is reports whether target is an *Error with the same Code as e. The inner errors of e and target
+// are not compared.
+//
+// Since errors.Is also checks each error wrapped by e, it matches the code of any nested huprt
+// error as well. For example, errors.Is(err, ErrPassFileSentinel) is true for an ErrRestart error
+// wrapping an ErrPassFile error.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || e == nil || t == nil {
+		return false
+	}
+	return e.Code == t.Code
 }
@@ -0,0 +1,155 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables describing the files passed to the new process through its Cmd's
+// ExtraFiles. HUPRT_FD_NAMES is a comma-separated list of names, one per file, where unnamed files
+// have an empty name.
+const (
+	numFDsEnvKey  = "HUPRT_NUM_FDS"
+	fdNamesEnvKey = "HUPRT_FD_NAMES"
+)
+
+// PassFile appends f to cmd's ExtraFiles under the given name, returning the file descriptor it
+// will have in the new process. The new process can retrieve it by name using InheritedFiles.
+// This is intended to be called from a Process's BeginRestart method. The name must not contain a
+// comma.
+//
+// f must remain open until the new process is started.
+func PassFile(cmd *exec.Cmd, name string, f *os.File) (fd int, err error) {
+	if strings.Contains(name, ",") {
+		return -1, &Error{ErrPassFile, fmt.Errorf("file name %q contains a comma", name)}
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	index := len(cmd.ExtraFiles) - 1
+
+	names := fdNames(cmd, index+1)
+	names[index] = name
+	setCmdEnv(cmd, fdNamesEnvKey, strings.Join(names, ","))
+
+	return firstExtraFD + index, nil
+}
+
+// fdNames returns the names of the files passed to cmd so far, padded with empty names to n files.
+func fdNames(cmd *exec.Cmd, n int) []string {
+	var names []string
+	if s := cmdEnv(cmd, fdNamesEnvKey); s != "" {
+		names = strings.Split(s, ",")
+	}
+	for len(names) < n {
+		names = append(names, "")
+	}
+	return names
+}
+
+// setFDEnv records the number of ExtraFiles passed to cmd, and their names, in its environment.
+// This is called by Restart after BeginRestart returns, so that files added to ExtraFiles without
+// PassFile are still counted.
+func setFDEnv(cmd *exec.Cmd) {
+	n := len(cmd.ExtraFiles)
+	setCmdEnv(cmd, numFDsEnvKey, strconv.Itoa(n))
+	setCmdEnv(cmd, fdNamesEnvKey, strings.Join(fdNames(cmd, n)[:n], ","))
+}
+
+// InheritedFiles returns the files passed to this process by its parent through its Cmd's
+// ExtraFiles, in order, along with a map of the named files (see PassFile). Files are numbered
+// from descriptor 3, following the ExtraFiles convention. If this process wasn't passed any
+// files, both results are empty.
+//
+// The returned files belong to the caller. Calling InheritedFiles more than once returns new
+// *os.File values for the same descriptors, so only one of them should be closed.
+func InheritedFiles() ([]*os.File, map[string]*os.File, error) {
+	named := map[string]*os.File{}
+
+	s, ok := os.LookupEnv(numFDsEnvKey)
+	if !ok {
+		return nil, named, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		err = fmt.Errorf("invalid %s: %q", numFDsEnvKey, s)
+		return nil, named, &Error{ErrInheritFile, err}
+	}
+
+	var names []string
+	if s := os.Getenv(fdNamesEnvKey); s != "" {
+		names = strings.Split(s, ",")
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		fileName := name
+		if fileName == "" {
+			fileName = "huprt-fd-" + strconv.Itoa(firstExtraFD+i)
+		}
+		files[i] = os.NewFile(uintptr(firstExtraFD+i), fileName)
+		if name != "" {
+			named[name] = files[i]
+		}
+	}
+	return files, named, nil
+}
+
+var (
+	ownedFilesMu sync.Mutex
+	// ownedFiles holds files created by huprt to pass to a Cmd, such as by PassFD, which must be
+	// closed once the Cmd's process has been started.
+	ownedFiles = map[*exec.Cmd][]*os.File{}
+)
+
+// ownFile records that f was created by huprt for cmd and must be closed by closeOwnedFiles.
+func ownFile(cmd *exec.Cmd, f *os.File) {
+	ownedFilesMu.Lock()
+	defer ownedFilesMu.Unlock()
+	ownedFiles[cmd] = append(ownedFiles[cmd], f)
+}
+
+// closeOwnedFiles closes the files huprt created for cmd. This is called by Restart once the new
+// process has been started, or has failed to start.
+func closeOwnedFiles(cmd *exec.Cmd) {
+	ownedFilesMu.Lock()
+	files := ownedFiles[cmd]
+	delete(ownedFiles, cmd)
+	ownedFilesMu.Unlock()
+	closeFiles(files)
+}
+
+// InheritedFD returns the file descriptor of the file passed to this process under the given name
+// by PassFile or PassFD, without wrapping it in an *os.File. This is useful for descriptors that
+// are used directly, such as an epoll or kqueue descriptor. If no file was passed under name, it
+// returns an ErrInheritFile error.
+func InheritedFD(name string) (int, error) {
+	n, err := strconv.Atoi(os.Getenv(numFDsEnvKey))
+	if err != nil {
+		n = 0
+	}
+
+	var names []string
+	if s := os.Getenv(fdNamesEnvKey); s != "" {
+		names = strings.Split(s, ",")
+	}
+	for i, fdName := range names {
+		if fdName == name && i < n {
+			return firstExtraFD + i, nil
+		}
+	}
+	return -1, &Error{ErrInheritFile, fmt.Errorf("no file named %q was passed to this process", name)}
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package huprt
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// PassFD passes the raw file descriptor fd to cmd. Raw file descriptors can only be passed on
+// Unix, so it always returns an ErrUnsupported error.
+func PassFD(cmd *exec.Cmd, fd int, name string) (int, error) {
+	return -1, &Error{ErrUnsupported, errors.New("PassFD requires Unix")}
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// PassFD passes the raw file descriptor fd to cmd under the given name, as PassFile does for an
+// *os.File, and returns the descriptor it will have in the new process. This allows passing
+// descriptors that aren't listeners or files, such as an epoll or kqueue descriptor held by an
+// event loop. The new process can retrieve it with InheritedFD, or as an *os.File with
+// InheritedFiles. The name must not contain a comma.
+//
+// fd is duplicated, so it remains owned by the caller and can be closed at any time. The duplicate
+// is closed by Restart once the new process has been started, or by Validate once it returns.
+func PassFD(cmd *exec.Cmd, fd int, name string) (int, error) {
+	// The duplicate is close-on-exec, so it's only inherited through the new process's
+	// ExtraFiles and not by any other process started while it's open. ForkLock keeps a fork
+	// from happening between the two calls. F_DUPFD_CLOEXEC would do both at once, but isn't
+	// available on every Unix.
+	syscall.ForkLock.RLock()
+	dup, err := syscall.Dup(fd)
+	if err == nil {
+		syscall.CloseOnExec(dup)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return -1, &Error{ErrPassFile, err}
+	}
+	f := os.NewFile(uintptr(dup), "huprt-fd-"+strconv.Itoa(fd))
+
+	childFD, err := PassFile(cmd, name, f)
+	if err != nil {
+		f.Close()
+		return -1, err
+	}
+	ownFile(cmd, f)
+	return childFD, nil
+}
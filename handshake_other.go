@@ -0,0 +1,130 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package huprt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Without Unix signals, the new process tells the old one to exit by connecting to a loopback TCP
+// socket opened by the old process and writing a token passed to it via its environment. The
+// token prevents unrelated local processes from completing the handshake.
+const (
+	handshakeAddrEnvKey  = "HUPRT_HANDSHAKE_ADDR"
+	handshakeTokenEnvKey = "HUPRT_HANDSHAKE_TOKEN"
+
+	// handshakeIOTimeout bounds how long either side of the handshake waits on a connection.
+	handshakeIOTimeout = 10 * time.Second
+)
+
+// parentProcess is the process that restarted this one.
+type parentProcess struct {
+	addr  string
+	token string
+}
+
+// PID returns the parent's process ID, as passed to this process in its environment, or zero if
+// it's unknown.
+func (p parentProcess) PID() int {
+	return envInt(parentPIDEnvKey)
+}
+
+// signal tells the parent process to exit. The signal itself isn't sent, since the parent only
+// waits for the Hupd's ReadySignal.
+func (p parentProcess) signal(sig syscall.Signal) error {
+	conn, err := net.DialTimeout("tcp", p.addr, handshakeIOTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(handshakeIOTimeout))
+	_, err = conn.Write([]byte(p.token + "\n"))
+	return err
+}
+
+// findParent returns the process that restarted this one. If this process wasn't given the
+// parent's handshake address, it returns an ErrOrphaned error.
+func findParent() (parentProcess, error) {
+	addr := os.Getenv(handshakeAddrEnvKey)
+	token := os.Getenv(handshakeTokenEnvKey)
+	if addr == "" || token == "" {
+		return parentProcess{}, &Error{ErrOrphaned, errors.New("no parent handshake address")}
+	}
+	return parentProcess{addr, token}, nil
+}
+
+// notifyKill returns a channel that receives the Hupd's ReadySignal once the new process, started
+// with cmd, connects to the handshake socket and writes its token. The returned function must be
+// called once the channel is no longer needed.
+func (h *Hupd) notifyKill(cmd *exec.Cmd) (<-chan os.Signal, func(), error) {
+	var tokenBytes [16]byte
+	if _, err := rand.Read(tokenBytes[:]); err != nil {
+		return nil, nil, err
+	}
+	token := hex.EncodeToString(tokenBytes[:])
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	setCmdEnv(cmd, handshakeAddrEnvKey, l.Addr().String())
+	setCmdEnv(cmd, handshakeTokenEnvKey, token)
+
+	sig := make(chan os.Signal, 1)
+	readySig := h.readySignal()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				// Closed by the returned function.
+				return
+			}
+			if checkHandshake(conn, token) {
+				sig <- readySig
+				return
+			}
+		}
+	}()
+
+	return sig, func() { l.Close() }, nil
+}
+
+// checkHandshake reads a line from conn and reports whether it matches token. conn is closed
+// before returning.
+func checkHandshake(conn net.Conn, token string) bool {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(handshakeIOTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return subtle.ConstantTimeCompare([]byte(line), []byte(token)) == 1
+}
+
+// forceExit terminates this process immediately.
+func forceExit() {
+	os.Exit(1)
+}
+
+// WaitParentExit waits for the process that restarted this one to exit. It is not supported on
+// this platform and always returns an ErrUnsupported error.
+func WaitParentExit(timeout time.Duration) error {
+	return &Error{ErrUnsupported, errors.New("WaitParentExit requires Unix signals")}
+}
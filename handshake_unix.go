@@ -0,0 +1,134 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// getppid and killProc are os.Getppid and unix.Kill. They're variables so that tests can stub them
+// out without needing a real parent process to signal.
+var (
+	getppid  = os.Getppid
+	killProc = unix.Kill
+)
+
+// parentProcess is the process that restarted this one.
+type parentProcess struct {
+	pid int
+}
+
+// PID returns the parent's process ID.
+func (p parentProcess) PID() int {
+	return p.pid
+}
+
+// signal sends sig to the parent process.
+func (p parentProcess) signal(sig syscall.Signal) error {
+	return killProc(p.pid, sig)
+}
+
+// findParent returns the process that restarted this one. If the parent has exited, it returns an
+// ErrOrphaned error.
+//
+// The PID passed by the parent via HUPRT_PARENT_PID is preferred over os.Getppid, since it allows
+// detecting that the parent has exited even if this process was reparented to a process other than
+// init. If it isn't set, it falls back to os.Getppid.
+func findParent() (parentProcess, error) {
+	ppid := getppid()
+
+	s, ok := os.LookupEnv(parentPIDEnvKey)
+	if !ok {
+		// If the parent has already exited, this process is reparented to init, which must not be
+		// signaled.
+		if ppid <= 1 {
+			return parentProcess{}, &Error{ErrOrphaned, nil}
+		}
+		return parentProcess{ppid}, nil
+	}
+
+	pid, err := strconv.Atoi(s)
+	if err != nil || pid <= 1 {
+		err = fmt.Errorf("invalid %s: %q", parentPIDEnvKey, s)
+		return parentProcess{}, &Error{ErrKillProcess, err}
+	}
+
+	// If the parent PID no longer matches, the parent exited and its PID may since have been
+	// reused by an unrelated process.
+	if pid != ppid {
+		err = fmt.Errorf("process %d is no longer the parent process", pid)
+		return parentProcess{}, &Error{ErrOrphaned, err}
+	}
+	if err := killProc(pid, 0); err == unix.ESRCH {
+		return parentProcess{}, &Error{ErrOrphaned, err}
+	}
+	return parentProcess{pid}, nil
+}
+
+// notifyKill returns a channel that receives the Hupd's ReadySignal once the new process, started
+// with cmd, sends it. The returned function must be called once the channel is no longer needed.
+func (h *Hupd) notifyKill(cmd *exec.Cmd) (<-chan os.Signal, func(), error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, h.readySignal())
+	return sig, func() { signal.Stop(sig) }, nil
+}
+
+// forceExit terminates this process immediately by sending it a SIGKILL.
+func forceExit() {
+	unix.Kill(os.Getpid(), unix.SIGKILL)
+}
+
+// parentPollInterval is how often WaitParentExit checks whether the parent process has exited.
+const parentPollInterval = 50 * time.Millisecond
+
+// WaitParentExit waits for the process that restarted this one to exit, polling it until it's gone
+// or timeout elapses. It's intended to be called after Start, to wait for the old process to
+// release its resources (such as sockets) before acquiring them. If timeout is zero or negative,
+// it waits indefinitely. If the timeout elapses first, an ErrTimeout error is returned.
+//
+// The parent is considered gone once it no longer exists or this process has been reparented. If
+// this process has no parent (i.e., it was reparented to init), WaitParentExit returns immediately.
+func WaitParentExit(timeout time.Duration) error {
+	pid := envInt(parentPIDEnvKey)
+	if pid <= 1 {
+		pid = getppid()
+	}
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+
+	ticker := time.NewTicker(parentPollInterval)
+	defer ticker.Stop()
+	for !parentExited(pid) {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return &Error{ErrTimeout, fmt.Errorf("parent process %d did not exit", pid)}
+		}
+	}
+	return nil
+}
+
+// parentExited reports whether the parent process pid has exited. Since an exited parent may
+// remain a zombie until reaped, this process being reparented is also treated as the parent
+// having exited.
+func parentExited(pid int) bool {
+	if pid <= 1 || getppid() != pid {
+		return true
+	}
+	return killProc(pid, 0) == unix.ESRCH
+}
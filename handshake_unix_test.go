@@ -0,0 +1,122 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// stubParent replaces getppid and killProc for the duration of the test. Signals sent by killProc
+// are recorded in sent.
+func stubParent(t *testing.T, ppid int, alive bool) (sent *[]syscall.Signal) {
+	t.Helper()
+	origGetppid, origKill := getppid, killProc
+	t.Cleanup(func() { getppid, killProc = origGetppid, origKill })
+
+	sent = new([]syscall.Signal)
+	getppid = func() int { return ppid }
+	killProc = func(pid int, sig syscall.Signal) error {
+		if pid != ppid {
+			t.Errorf("signaled process %d; want %d", pid, ppid)
+		}
+		if !alive {
+			return unix.ESRCH
+		}
+		if sig != 0 {
+			*sent = append(*sent, sig)
+		}
+		return nil
+	}
+	return sent
+}
+
+func TestFindParent(t *testing.T) {
+	tests := []struct {
+		name     string
+		ppid     int
+		alive    bool
+		env      string
+		setEnv   bool
+		wantPID  int
+		wantErr  bool
+		wantCode Code
+	}{
+		{name: "getppid", ppid: 100, alive: true, wantPID: 100},
+		{name: "reparented to init", ppid: 1, alive: true, wantErr: true, wantCode: ErrOrphaned},
+		{name: "env", ppid: 100, alive: true, env: "100", setEnv: true, wantPID: 100},
+		{
+			name: "env mismatch", ppid: 1, alive: true, env: "100", setEnv: true,
+			wantErr: true, wantCode: ErrOrphaned,
+		},
+		{
+			name: "env exited", ppid: 100, env: "100", setEnv: true,
+			wantErr: true, wantCode: ErrOrphaned,
+		},
+		{
+			name: "env invalid", ppid: 100, alive: true, env: "x", setEnv: true,
+			wantErr: true, wantCode: ErrKillProcess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubParent(t, tt.ppid, tt.alive)
+			if tt.setEnv {
+				t.Setenv(parentPIDEnvKey, tt.env)
+			} else {
+				t.Setenv(parentPIDEnvKey, "")
+				os.Unsetenv(parentPIDEnvKey)
+			}
+
+			p, err := findParent()
+			if tt.wantErr || err != nil {
+				var he *Error
+				if !errors.As(err, &he) || he.Code != tt.wantCode {
+					t.Fatalf("findParent() error = %v; want code %v", err, tt.wantCode)
+				}
+				return
+			}
+			if p.PID() != tt.wantPID {
+				t.Errorf("findParent() PID = %d; want %d", p.PID(), tt.wantPID)
+			}
+		})
+	}
+}
+
+func TestStartSignalsParent(t *testing.T) {
+	sent := stubParent(t, 100, true)
+	t.Setenv(parentPIDEnvKey, "100")
+
+	h := &Hupd{}
+	if err := h.Start(true); err != nil {
+		t.Fatalf("Start(true) error = %v", err)
+	}
+	if len(*sent) != 1 || (*sent)[0] != syscall.SIGTERM {
+		t.Errorf("sent %v to the parent; want [%v]", *sent, syscall.SIGTERM)
+	}
+	if pid, signaled, _ := h.StartInfo(); pid != 100 || !signaled {
+		t.Errorf("StartInfo() = %d, %t; want 100, true", pid, signaled)
+	}
+}
+
+func TestStartOnBeforeKillParentError(t *testing.T) {
+	sent := stubParent(t, 100, true)
+	t.Setenv(parentPIDEnvKey, "100")
+
+	h := &Hupd{OnBeforeKillParent: func() error { return errors.New("draining") }}
+	if err := h.Start(true); !errors.Is(err, ErrKillProcessSentinel) {
+		t.Errorf("Start(true) error = %v; want an ErrKillProcess error", err)
+	}
+	if len(*sent) != 0 {
+		t.Errorf("sent %v to the parent; want none", *sent)
+	}
+}
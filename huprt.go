@@ -6,19 +6,30 @@
 // other Go packages, but only intended to cover the handshake in restarting a process. It does not
 // manage HTTP[S] server lifecycles, requests, or anything else.
 //
-// BUG(ncower): Due to the dependency on Unix signals and the sys/unix package, the huprt package
-// is not expected to work on Windows or non-Unix systems. Future work-arounds for this may reduce
-// the dependence on signals but require other IPC methods. For now, not supporting Windows is
-// acceptable.
+// On non-Unix systems, such as Windows, the new process tells the old one to exit by connecting to
+// a loopback TCP socket opened by the old process instead of sending it a signal. The restart
+// signal is still used by NotifyRestart, but since Windows has no SIGHUP, restarts there must
+// usually be triggered by calling Restart directly.
+//
+// BUG(ncower): On non-Unix systems, features that rely on passing file descriptors through a Cmd's
+// ExtraFiles (such as PassListener and the ReadyPipe handshake) are not supported.
 package huprt
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 // Process defines an interface for any process that can be killed so that it may be restarted.
@@ -34,15 +45,18 @@ import (
 //
 // Once BeginRestart has completed, and provided that the Cmd has not been configured incorrectly,
 // a new process is started using that Cmd. Once successfully started, the new process will notify
-// the old one via SIGTERM that it should exit. At that point, the Kill method is called and the
-// program must exit.
+// the old one via SIGTERM (or the Hupd's KillSignal, if set) that it should exit. At that point,
+// the Kill method is called and the program must exit.
 //
 // If at any point during this process an error occurs, such as if BeginRestart returns an error or
 // the new process cannot be started, the Hupd will return an error and allow the program to decide
 // how to proceed. The Kill method is never called if an error is returned.
 //
-// It is particularly important, during BeginRestart, to stop handling SIGTERM, as Hupd uses this
-// to know when to invoke its Kill method.
+// Hupd starts handling SIGTERM (or the configured ReadySignal) before calling BeginRestart, so the
+// program doesn't need to stop handling it during a restart for Hupd to see the new process's
+// signal. Any handlers the program has registered with os/signal still receive it as well, so if
+// they would treat it as a shutdown, set ReadySignal to a signal the program doesn't otherwise
+// handle.
 //
 // Essentially, the flow from Hupd.Restart to BeginRestart to Kill behaves roughly like the
 // following diagram:
@@ -63,119 +77,1733 @@ type Process interface {
 	Kill()
 }
 
+// ErrProcess is an optional interface that a Process can implement to report errors from killing
+// it. If a Process implements ErrProcess, its KillErr method is called instead of Kill, and any
+// error it returns is returned by Restart as an ErrKill error.
+type ErrProcess interface {
+	KillErr() error
+}
+
+// PrepareProcess is an optional interface that a Process can implement to make restarts
+// transactional. If a Process implements PrepareProcess, its Prepare method is called instead of
+// BeginRestart. Prepare configures the Cmd as BeginRestart would, but may hold on to its resources
+// until the new process has been started, returning functions to finish the restart.
+//
+// If the new process is started, commit is called, and should release any resources that the new
+// process needs. If the restart fails before then (for example, because the new process couldn't
+// be started), rollback is called instead, and should undo anything Prepare did so that the
+// process can keep running. Exactly one of them is called. If the restart fails after commit is
+// called, the Process is resumed as usual if it implements Resumable.
+//
+// If Prepare returns an error, neither function is called. Either may be nil.
+type PrepareProcess interface {
+	Prepare(*exec.Cmd) (commit func(), rollback func(), err error)
+}
+
+// DefaultProcess is the Process used by a Hupd whose Process is nil, unless its RequireProcess
+// field is set. Its BeginRestart method releases nothing, and its Kill method exits the program
+// with status 0. It's suitable for programs with no resources that the new process needs.
+var DefaultProcess Process = NewProcess(nil, ExitKill(0))
+
+// ExitKill returns a function that exits the program with the given status, for use as the kill
+// function passed to NewProcess by programs with nothing to clean up. Programs that need to clean
+// up in Kill before exiting can instead set the Hupd's ExitOnKill and ExitStatus fields.
+func ExitKill(code int) func() {
+	return func() { os.Exit(code) }
+}
+
+// NewProcess returns a Process whose BeginRestart and Kill methods call begin and kill,
+// respectively. Either may be nil, in which case the corresponding method does nothing.
+func NewProcess(begin func(*exec.Cmd) error, kill func()) Process {
+	// A pointer, so that the result can be compared with DefaultProcess.
+	return &processFuncs{begin: begin, kill: kill}
+}
+
+type processFuncs struct {
+	begin func(*exec.Cmd) error
+	kill  func()
+}
+
+func (p processFuncs) BeginRestart(cmd *exec.Cmd) error {
+	if p.begin == nil {
+		return nil
+	}
+	return p.begin(cmd)
+}
+
+func (p processFuncs) Kill() {
+	if p.kill != nil {
+		p.kill()
+	}
+}
+
 // Hupd is responsible for restarting the host process and killing its parent process (if in the
 // new process).
+//
+// Both the old and new processes must use the same Hupd configuration for the restart handshake
+// to work. In particular, if KillSignal differs between the two, the new process will send a
+// signal the old process isn't waiting for.
 type Hupd struct {
 	Process
 
+	// RestartArg is the argument passed to the new process to tell it that it was started by a
+	// restart. If empty, it defaults to "-restart". It must start with a dash, so a positional
+	// token such as "restart" isn't accepted; Restart and New return an ErrRestartArg error for
+	// one.
 	RestartArg string
 	Timeout    time.Duration
+
+	// RequireProcess, if true, makes restarting a Hupd whose Process is nil fail with an
+	// ErrNoProcess error, rather than use DefaultProcess.
+	RequireProcess bool
+
+	// RestartArgIndex is the position of the restart argument in the new process's arguments,
+	// where 0 is the first argument after the program name. This is useful for programs that take
+	// a subcommand as their first argument. If it's past the end of the arguments, the restart
+	// argument is appended.
+	RestartArgIndex int
+
+	// RestartArgAliases are other arguments also recognized as the restart argument, such as
+	// "--restart" for programs using GNU-style flags. Any occurrence of RestartArg or an alias is
+	// removed from the new process's arguments before RestartArg is inserted at
+	// RestartArgIndex. As with RestartArg, each alias must start with a dash.
+	RestartArgAliases []string
+
+	// DetectRestart, if set, is used by FromRestart (and so StartAuto) to decide whether this
+	// process was started by a restart, in place of looking for the restart argument. It is
+	// passed a copy of os.Args. This allows programs with complex command lines to detect a
+	// restart some other way, such as by looking for the restart argument anywhere in their
+	// arguments.
+	DetectRestart func(args []string) bool
+
+	// ReservedArgs are arguments the program itself uses, such as its own flags. Restart returns an
+	// ErrRestartArg error without restarting if RestartArg or any of its aliases is one of them,
+	// since the new process would misinterpret its arguments. It does the same if RestartArg or
+	// any of its aliases doesn't start with a dash.
+	ReservedArgs []string
+
+	// KillSignal is the signal sent by the new process to tell the old process to exit. If zero,
+	// it defaults to SIGTERM.
+	KillSignal syscall.Signal
+
+	// ReadySignal, if set, is the signal sent by the new process to tell the old process that it
+	// is ready, in place of the KillSignal. On receiving it, the old process calls its Process's
+	// Kill method itself. This separates "the new process is ready" from "this process should
+	// exit": when ReadySignal differs from KillSignal, huprt doesn't handle the KillSignal during
+	// a restart, so it keeps whatever meaning the program gives it. If zero, it defaults to the
+	// KillSignal.
+	ReadySignal syscall.Signal
+
+	// ForwardSignals are signals that, if received while waiting for the new process to complete
+	// the handshake, are also sent to the new process. This allows an external shutdown (such as
+	// a SIGINT from a container runtime) that arrives mid-restart to reach both processes. Any
+	// handlers the program has registered with os/signal still receive them as well. While
+	// forwarding, these signals don't have their default effect on this process, so programs
+	// that rely on that should handle them with os/signal.
+	//
+	// The ReadySignal is never forwarded unless ReadyPipe or VerifySender is set. os/signal
+	// doesn't expose the sender of a signal, so huprt can't tell a ReadySignal sent by the new
+	// process from one sent by any other process. If that ambiguity matters, set VerifySender,
+	// since only the new process can complete the handshake through the pipe.
+	ForwardSignals []syscall.Signal
+
+	// CancelSignals are signals that cancel a restart if received while waiting for the new
+	// process to complete the handshake, such as an operator pressing Ctrl-C. The restart returns
+	// an ErrCanceled error, the new process is killed, and the Process's Kill method is not
+	// called. If nil, it defaults to SIGINT. Set it to an empty, non-nil slice to disable
+	// cancellation by signal. The ReadySignal is never treated as a cancel signal.
+	CancelSignals []syscall.Signal
+
+	// RestartSignal is the signal NotifyRestart waits for before restarting. If zero, it defaults
+	// to SIGHUP. It must not be the same as the KillSignal or ReadySignal.
+	RestartSignal syscall.Signal
+
+	// CoalesceWindow, if greater than zero, makes NotifyRestartLoop wait this long after
+	// receiving a restart signal before restarting, collapsing any further restart signals
+	// received in that time into the same restart. This prevents a burst of signals (such as
+	// from configuration management re-sending them) from causing repeated restarts.
+	CoalesceWindow time.Duration
+
+	// OnSpawn, if set, is called with the new process's PID once it has been started. It is
+	// called before waiting for the new process to send the KillSignal, so it is called even if
+	// the restart later times out or is canceled.
+	OnSpawn func(pid int)
+
+	// OnChildExit, if set, is called from a separate goroutine with the new process's state once
+	// it exits, whether that's before the handshake completes or after it has taken over. Since
+	// the old process normally exits once the handshake completes, this mostly matters when it
+	// keeps running, such as after a failed restart, where it can detect a new process that died
+	// after taking over.
+	OnChildExit func(*os.ProcessState)
+
+	// KillGrace, if greater than zero, is how long the process has to exit once Kill is called.
+	// If the process is still running after KillGrace has elapsed, it sends itself a SIGKILL.
+	// This guards against Kill implementations that hang or don't exit the program.
+	KillGrace time.Duration
+
+	// ExitOnKill, if true, makes the Hupd call os.Exit with ExitStatus once the Process's Kill
+	// method returns. Kill is still called first, so it can be used for cleanup.
+	ExitOnKill bool
+	// ExitStatus is the status the program exits with if ExitOnKill is true.
+	ExitStatus int
+
+	// OnExit, if set, is called once the Process's Kill method has returned successfully after a
+	// restart, just before Restart returns (or, if ExitOnKill is set, before exiting). It allows
+	// for final cleanup or logging of the handoff. It is not called if Kill exits the program or
+	// returns an error.
+	OnExit func()
+
+	// PIDFile, if set, is the path of a file that Start writes this process's PID to once it has
+	// succeeded. The file is written atomically, replacing any existing file, so a process started
+	// by a restart overwrites its parent's PID and a stale file from an earlier run is replaced.
+	// In processes started by RestartN, only the first new process writes its PID. The file isn't
+	// removed when the process exits after a restart; call RemovePIDFile on a clean shutdown.
+	PIDFile string
+
+	// NewProcessGroup, if true, starts the new process in its own process group (by setting
+	// Setpgid in its Cmd's SysProcAttr before BeginRestart is called), so that signals sent to
+	// this process's group, such as a SIGINT from the terminal, don't also reach the new process.
+	// The handshake is unaffected, since the new process signals this one by PID. Note that a new
+	// process outside the terminal's foreground process group is stopped if it reads from the
+	// terminal. NewProcessGroup is only supported on Unix; elsewhere, Restart returns an
+	// ErrUnsupported error.
+	NewProcessGroup bool
+
+	// SysProcAttr, if set, is copied to the new process's Cmd before BeginRestart is called,
+	// giving full control over OS-specific attributes of the new process, such as its
+	// credentials, cgroup, or namespaces on Linux. NewProcessGroup and Detach are applied on top
+	// of it, so they take precedence over the corresponding attributes.
+	SysProcAttr *syscall.SysProcAttr
+
+	// Detach, if true, starts the new process in a new session (by setting Setsid in its Cmd's
+	// SysProcAttr), detaching it from this process's controlling terminal so that it survives the
+	// terminal closing. Unless Stdin, Stdout, or Stderr are set, the new process's standard
+	// streams are connected to the null device instead of this process's, and InheritStdin is
+	// ignored. A new session is also a new process group, so NewProcessGroup has no further
+	// effect. The handshake is unaffected, since the new process finds this one through the
+	// parent PID passed in its environment. Detach is only supported on Unix; elsewhere, Restart
+	// returns an ErrUnsupported error.
+	Detach bool
+
+	// KillChildOnFailure, if true, makes a restart that fails after the new process was started
+	// (for example, because it timed out or failed its HealthCheck) kill the new process and wait
+	// for it to exit before returning. This ensures a failed restart doesn't leave a second copy
+	// of the program running, holding resources the Process may need to resume. The tradeoff is
+	// that a new process that was merely slow to complete the handshake is killed rather than
+	// given the chance to recover or be adopted.
+	//
+	// If false, the new process is left running and the error wraps a *ChildError with its PID
+	// where possible. It is still waited on in the background, so it won't become a zombie when
+	// it exits.
+	KillChildOnFailure bool
+
+	// BuildArgs, if set, is called to build the argument list, including the program name, for
+	// the new process. It is passed a copy of os.Args and the restart argument. If nil, the
+	// restart argument is prepended to the current arguments if not already present.
+	BuildArgs func(oldArgs []string, restartArg string) []string
+
+	// InspectCmd, if set, is called during a restart with the Cmd for the new process, after
+	// BeginRestart has returned and just before the new process is started. It may log or modify
+	// the Cmd's arguments, environment, and files. If it returns an error, the new process isn't
+	// started and the restart fails with an ErrNewProcess error wrapping it. The number and names
+	// of the Cmd's ExtraFiles are recorded in its environment afterward, so files added by
+	// InspectCmd are included.
+	InspectCmd func(*exec.Cmd) error
+
+	// SnapshotState, if set, is called during a restart, after BeginRestart returns, to get state
+	// to hand off to the new process, such as counters or cached tokens. The state is written to a
+	// temporary file readable only by this user, and the new process reads it with RestoreState,
+	// which removes the file. If the restart fails before the new process is started, the file is
+	// removed. If SnapshotState returns an error, the restart fails with an ErrState error.
+	SnapshotState func() ([]byte, error)
+
+	// NextArgs, if not empty, is the argument list, including the program name, for the new
+	// process, in place of os.Args. The restart argument is still removed from it and inserted at
+	// RestartArgIndex, as it is for os.Args. NextArgs takes precedence over BuildArgs, which isn't
+	// called when NextArgs is set.
+	NextArgs []string
+
+	// Binary, if set, is the path of the executable to start for the new process. If empty, the
+	// program's own executable is used, as resolved when the program started. Setting Binary is
+	// useful for restarting into a different executable, such as during an upgrade.
+	Binary string
+
+	// UpgradeInPlace, if true, makes Restart look up the program's executable in PATH again each
+	// time it restarts if the program was invoked by a bare name, rather than using the path
+	// found when the program started. This is intended for deployments that install a new
+	// executable elsewhere in PATH and then restart into it. An executable replaced at the same
+	// path, or a symlink to it that's changed, is used by a restart either way, since the path
+	// the program was invoked by is used without evaluating symlinks. It has no effect if Binary
+	// is set, since Binary always takes precedence.
+	UpgradeInPlace bool
+
+	// WorkingDir, if set, is the working directory of the new process. If empty, the new process
+	// uses the current working directory at the time of the restart.
+	WorkingDir string
+
+	// Stdin, if set, is the new process's standard input. If nil and InheritStdin is true, the
+	// new process uses this process's standard input. Otherwise, the new process's standard input
+	// is the null device.
+	//
+	// When the new process inherits os.Stdin, both processes share the same descriptor until the
+	// old process exits, so input may be read by either process during the restart.
+	Stdin        io.Reader
+	InheritStdin bool
+
+	// Stdout and Stderr, if set, are the new process's standard output and standard error. If
+	// nil, the new process uses this process's standard output and standard error.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// SyncOutput, if true, makes the Hupd flush its Stdout and Stderr (or this process's standard
+	// output and standard error, if nil) before calling the Process's Kill method, so that output
+	// isn't lost if the program exits. Writers with a Flush() error method are flushed and
+	// writers with a Sync() error method, such as *os.File, are synced. Other writers are left
+	// alone.
+	SyncOutput bool
+
+	// TagOutput, if true, prefixes each line the new process writes to its standard output and
+	// standard error with its generation (such as "[gen 2] ") before writing it to Stdout and
+	// Stderr (or this process's standard output and standard error). This makes it possible to
+	// tell which process wrote a line while both are running.
+	//
+	// Since the new process's output is copied through this process, it's lost once this process
+	// exits, after which the new process's writes to standard output and standard error fail (on
+	// Unix, with a SIGPIPE that kills it unless handled). TagOutput is only suitable where the old
+	// process keeps running, such as under a supervisor, or for debugging.
+	TagOutput bool
+
+	// Env, if non-nil, is the environment of the new process. If nil, the new process inherits
+	// this process's environment. In either case, huprt adds its own variables to the new
+	// process's environment, such as HUPRT_PARENT_PID.
+	Env []string
+
+	// EnvAllow and EnvDeny filter the environment inherited by the new process when Env is nil,
+	// such as to drop secrets that should be regenerated. If EnvAllow is not empty, only the
+	// variables it matches are kept. Any variables matched by EnvDeny are then removed, so EnvDeny
+	// takes precedence over EnvAllow. Each entry is a variable name, or a prefix followed by "*"
+	// to match all variables starting with it (such as "AWS_*"). huprt's own variables are always
+	// added afterward.
+	EnvAllow []string
+	EnvDeny  []string
+
+	// GenerationEnvKey is the name of the environment variable holding the number of times the
+	// process has been restarted. If empty, it defaults to HUPRT_GENERATION. The new process
+	// receives this process's value for it plus one (an unset or invalid value is treated as
+	// zero). This is added to Env, or to this process's environment if Env is nil.
+	GenerationEnvKey string
+
+	// ReadyPipe, if true, makes the restart handshake use a pipe instead of the KillSignal. The
+	// new process is passed the write end of the pipe and must call SignalReady (or ReportReady)
+	// once it is ready to take over, at which point the old process's Kill method is called. When
+	// ReadyPipe is true, Start does not send the KillSignal to the parent process, and the parent
+	// doesn't handle the ReadySignal during the restart, so it's left to the program's own
+	// handling.
+	ReadyPipe bool
+
+	// VerifySender, if true, ensures that only the new process can complete the handshake, so a
+	// ReadySignal sent by another process (such as a stray kill from an operator) doesn't make
+	// this process exit. os/signal doesn't expose the sender of a signal, so the sender's PID
+	// can't be checked. Instead, the handshake uses a readiness pipe that only the new process
+	// holds, as with ReadyPipe, and Start in the new process writes to it in place of sending the
+	// ReadySignal. A ReadySignal received while waiting isn't handled by huprt, so it's left to
+	// the program's own handling (by default, SIGTERM terminates the process).
+	VerifySender bool
+
+	// OnStartFromRestart, if set, is called by Start in the new process when it was started by
+	// a restart. This can be used for initialization that only a restarted process needs, such as
+	// reclaiming inherited file descriptors.
+	OnStartFromRestart func()
+
+	// OnBeforeKillParent, if set, is called by Start in the new process before it signals the old
+	// process to exit, whether by signal or, such as in a process started by RestartN, through its
+	// readiness pipe. If it returns an error, the old process is not signaled.
+	OnBeforeKillParent func() error
+
+	// OnReady, if set, is called once the new process has completed the handshake, before the
+	// HealthCheck and Kill. It's passed the status the new process reported with ReportReady,
+	// such as its version or the ports it's listening on, which is useful for logging the handoff.
+	// The status is nil if the new process didn't report one, such as when it used SignalReady or
+	// the ReadySignal handshake.
+	OnReady func(status map[string]string)
+
+	// ReloadFunc, if set, is called in place of a restart when the restart signal is received by
+	// NotifyRestart (or a variant) or Run, allowing the same signal, such as SIGHUP, to be used
+	// to reload the program's configuration. The decision is made each time the signal is
+	// received:
+	//
+	//   - If ReloadFunc is nil, the process is restarted.
+	//   - If RestartIfBinaryChanged is true and the executable the new process would be started
+	//     from has been replaced or modified since Start was called, the process is restarted.
+	//   - Otherwise, ReloadFunc is called and the process is not restarted.
+	//
+	// After a successful reload, NotifyRestart and its variants continue to wait for the restart
+	// signal. If ReloadFunc returns an error, it is returned as an ErrReload error, except by
+	// NotifyRestartLoop, which passes it to its onErr function, and Run, which logs it and waits
+	// for the next signal. Restart, RestartNow, and the control socket always restart the process.
+	ReloadFunc func() error
+
+	// RestartIfBinaryChanged, if true, makes the restart signal restart the process instead of
+	// calling ReloadFunc once the executable has changed on disk, such as after an upgrade. The
+	// executable is compared by file identity, size, and modification time. It has no effect if
+	// ReloadFunc is nil.
+	RestartIfBinaryChanged bool
+
+	// Logger, if set, is used to log each stage of a restart and any errors that occur.
+	Logger Logger
+
+	// Clock, if set, is used to wait for the Timeout and CoalesceWindow. If nil, real time is
+	// used. This is intended for tests that need to trigger timeouts deterministically.
+	Clock Clock
+
+	// SpawnRetries is the number of times to retry starting the new process if it fails with a
+	// temporary error, such as EAGAIN from fork. Other errors are not retried.
+	SpawnRetries int
+	// SpawnRetryDelay is how long to wait before the first retry. Each subsequent retry waits
+	// twice as long as the previous one, plus some random jitter.
+	SpawnRetryDelay time.Duration
+
+	// StackDumpOnTimeout, if true, writes the stacks of all goroutines to Stderr (or os.Stderr, if
+	// Stderr is nil) when a restart times out. This can help find deadlocks in BeginRestart.
+	StackDumpOnTimeout bool
+
+	// HealthCheck, if set, is called once the new process has completed the handshake but before
+	// the Process's Kill method is called. If it returns an error, the restart fails with an
+	// ErrUnhealthy error and Kill is not called.
+	HealthCheck func() error
+
+	// OnRestartComplete, if set, is called when a restart finishes with the time taken by the
+	// restart and the error it returned, if any. If the restart succeeds but the Process's Kill
+	// method exits the program, it is not called.
+	OnRestartComplete func(d time.Duration, err error)
+
+	// Deadline, if greater than zero, bounds the whole restart, from the start of Restart through
+	// BeginRestart, starting the new process, and the handshake, whereas Timeout applies to each
+	// of those phases separately. If the Deadline passes first, the restart stops and returns an
+	// ErrTimeout error.
+	Deadline time.Duration
+
+	// MaxRestarts, if greater than zero, is the most restarts that may be attempted within any
+	// RestartWindow. Once it's reached, Restart returns an ErrRateLimited error without calling
+	// BeginRestart until enough of the earlier attempts fall outside the window. This guards
+	// against a misbehaving source of restart signals cycling the process continuously. Both
+	// MaxRestarts and RestartWindow must be set for restarts to be limited.
+	MaxRestarts   int
+	RestartWindow time.Duration
+
+	// restarts is the number of restarts attempted.
+	restarts atomic.Uint64
+
+	// restarting is set to 1 while a restart is in progress. It must be accessed atomically.
+	restarting int32
+
+	// inBeginRestart is set to 1 while the Process's BeginRestart (or Prepare) method is running,
+	// which may outlast the restart that called it if it times out. It must be accessed
+	// atomically.
+	inBeginRestart int32
+
+	// mu guards startedAt, generation, startInfo, and binaryInfo, which are set by Start, as well
+	// as recent and stopped.
+	mu         sync.Mutex
+	startedAt  time.Time
+	generation int
+
+	// recent holds the times of the restarts attempted within the last RestartWindow.
+	recent []time.Time
+
+	// startInfo is the outcome of the last call to Start.
+	startInfo startInfo
+
+	// binaryInfo describes the executable as of the last call to Start, for RestartIfBinaryChanged.
+	binaryInfo os.FileInfo
+
+	// stopped is closed by Stop. It's created on first use.
+	stopped chan struct{}
+}
+
+// recoverable reports whether the Process can recover from a restart that fails after its
+// BeginRestart method has returned, either by resuming, by rolling back, or because it's
+// DefaultProcess, which releases nothing.
+func (h *Hupd) recoverable() bool {
+	switch p := h.process(); p.(type) {
+	case Resumable, PrepareProcess:
+		return true
+	default:
+		return p == DefaultProcess
+	}
+}
+
+// process returns the Hupd's Process, or DefaultProcess if it's nil and RequireProcess isn't set.
+func (h *Hupd) process() Process {
+	if h.Process == nil && !h.RequireProcess {
+		return DefaultProcess
+	}
+	return h.Process
+}
+
+func (h *Hupd) killSignal() syscall.Signal {
+	if h.KillSignal == 0 {
+		return syscall.SIGTERM
+	}
+	return h.KillSignal
+}
+
+func (h *Hupd) readySignal() syscall.Signal {
+	if h.ReadySignal == 0 {
+		return h.killSignal()
+	}
+	return h.ReadySignal
+}
+
+// readyPipe reports whether the new process completes the handshake through a readiness pipe,
+// rather than by sending the ReadySignal, as is the case if ReadyPipe or VerifySender is set.
+func (h *Hupd) readyPipe() bool {
+	return h.ReadyPipe || h.VerifySender
+}
+
+// signalConflict returns whether the restart signal is also used for the restart handshake.
+func (h *Hupd) signalConflict() bool {
+	restartSig := h.restartSignal()
+	return restartSig == h.killSignal() || restartSig == h.readySignal()
+}
+
+func (h *Hupd) restartArg() string {
+	if len(h.RestartArg) == 0 {
+		return "-restart"
+	}
+	return h.RestartArg
+}
+
+// validateRestartArg returns an ErrRestartArg error if the restart argument or any of its aliases
+// doesn't start with a dash or is one of the Hupd's ReservedArgs.
+func (h *Hupd) validateRestartArg() error {
+	args := append([]string{h.restartArg()}, h.RestartArgAliases...)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return &Error{ErrRestartArg, fmt.Errorf("%q does not start with a dash", arg)}
+		}
+		for _, reserved := range h.ReservedArgs {
+			if arg == reserved {
+				return &Error{ErrRestartArg, fmt.Errorf("%q is a reserved argument", arg)}
+			}
+		}
+	}
+	return nil
+}
+
+// isRestartArg returns whether arg is the restart argument or one of its aliases.
+func (h *Hupd) isRestartArg(arg string) bool {
+	if arg == h.restartArg() {
+		return true
+	}
+	for _, alias := range h.RestartArgAliases {
+		if arg == alias {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hupd) generationEnvKey() string {
+	if h.GenerationEnvKey == "" {
+		return "HUPRT_GENERATION"
+	}
+	return h.GenerationEnvKey
+}
+
+func (h *Hupd) restartSignal() syscall.Signal {
+	if h.RestartSignal == 0 {
+		return syscall.SIGHUP
+	}
+	return h.RestartSignal
+}
+
+// Signals returns the signals the Hupd registers handlers for, with defaults applied. restart is
+// the signal NotifyRestart waits for. kill is the signal handled during a restart to learn that
+// the new process is ready: the ReadySignal, or the KillSignal if ReadySignal is unset. This is
+// useful for keeping other signal handling code from conflicting with huprt's.
+func (h *Hupd) Signals() (restart, kill syscall.Signal) {
+	return h.restartSignal(), h.readySignal()
 }
 
 // Start tells Hupd that the program is starting and whether it's starting up from a process that
-// is restarting. If fromRestart is true, the parent process is sent a SIGTERM to tell it to exit.
+// is restarting. It records the time it was called and the process's generation, which are
+// returned by StartedAt and Generation.
+//
+// If fromRestart is true, the parent process is sent the Hupd's ReadySignal (the KillSignal, or
+// SIGTERM, by default) to tell it to exit. If the Hupd's ReadyPipe field is true, no signal is
+// sent and SignalReady must be called instead. In a process started by RestartN, Start calls
+// SignalReady in place of sending the signal.
+//
+// If fromRestart is true and the Hupd's OnStartFromRestart field is set, it is called first,
+// before anything else is done.
+//
+// If the parent process has already exited, an ErrOrphaned error is returned and no signal is
+// sent.
+//
+// If the Hupd's OnBeforeKillParent field is set, it is called before sending the signal. If it
+// returns an error, the signal is not sent and the error is returned as an ErrKillProcess error.
+//
+// If an error occurs when sending the signal, that error is returned.
 //
-// If an error occurs when sending the SIGTERM, that error is returned.
+// If the Hupd's PIDFile field is set and no error occurred, this process's PID is written to it.
+// If that fails, an ErrPIDFile error is returned.
 func (h *Hupd) Start(fromRestart bool) error {
+	var binaryInfo os.FileInfo
+	if h.ReloadFunc != nil && h.RestartIfBinaryChanged {
+		binaryInfo, _ = os.Stat(h.binary())
+	}
+
+	h.mu.Lock()
+	h.startedAt = time.Now()
+	h.generation = 0
+	if fromRestart {
+		h.generation = envInt(h.generationEnvKey())
+	}
+	h.binaryInfo = binaryInfo
+	h.mu.Unlock()
+
+	info := h.start(fromRestart)
+	if info.err == nil && ChildIndex() <= 0 {
+		info.err = h.writePIDFile()
+	}
+
+	h.mu.Lock()
+	h.startInfo = info
+	h.mu.Unlock()
+	return info.err
+}
+
+// startInfo describes the outcome of a call to Start.
+type startInfo struct {
+	parentPID int
+	signaled  bool
+	err       error
+}
+
+// start performs the parent handshake for Start and returns its outcome.
+func (h *Hupd) start(fromRestart bool) startInfo {
 	if !fromRestart {
-		return nil
+		return startInfo{}
 	}
 
-	ppid := os.Getppid()
-	if err := unix.Kill(ppid, unix.SIGTERM); err != nil {
+	if h.OnStartFromRestart != nil {
+		h.OnStartFromRestart()
+	}
+
+	if h.ReadyPipe {
+		return startInfo{}
+	}
+
+	// A process started by RestartN reports that it's ready through its readiness pipe, since
+	// its parent can't tell apart signals sent by several new processes. The same goes for a
+	// parent that verifies the sender.
+	if ChildIndex() >= 0 || os.Getenv(readyOnStartEnvKey) == "1" {
+		parentPID := envInt(parentPIDEnvKey)
+		if err := h.beforeKillParent(); err != nil {
+			return startInfo{parentPID, false, err}
+		}
+		if err := SignalReady(); err != nil {
+			return startInfo{parentPID, false, err}
+		}
+		return startInfo{parentPID, true, nil}
+	}
+
+	parent, err := findParent()
+	if err != nil {
+		return startInfo{err: err}
+	}
+
+	if err := h.beforeKillParent(); err != nil {
+		return startInfo{parent.PID(), false, err}
+	}
+
+	if err := parent.signal(h.readySignal()); err != nil {
+		return startInfo{parent.PID(), false, &Error{ErrKillProcess, err}}
+	}
+	return startInfo{parent.PID(), true, nil}
+}
+
+// beforeKillParent calls the Hupd's OnBeforeKillParent hook, if set, returning any error it
+// returns as an ErrKillProcess error.
+func (h *Hupd) beforeKillParent() error {
+	if h.OnBeforeKillParent == nil {
+		return nil
+	}
+	if err := h.OnBeforeKillParent(); err != nil {
 		return &Error{ErrKillProcess, err}
 	}
 	return nil
 }
 
-// restartCmd creates and returns an execCmd based on the initial program startup options
-// (i.e., cmd.Path is the first CLI argument and all others are passed through as its arguments).
+// StartInfo returns the outcome of the last call to Start: the PID of the parent process it found,
+// whether the parent was sent the ReadySignal, and the error Start returned. If Start hasn't been
+// called, or was called with fromRestart false, parentPID is 0 and signaled is false. This is
+// useful for logging which process was told to exit.
 //
-// Only the first argument is checked for the restart argument, hupArg. If it isn't already the
-// first argument, it is prepended to the argument list. As a result, the arguments for a
-// restarting process should always be predictable both for the new process and the Hupd process's
-// BeginRestart method.
-func restartCmd(hupArg string) exec.Cmd {
-	var cmd exec.Cmd
-	var binpath = os.Args[0]
-	var args []string
+// If the Hupd's ReadyPipe field is true, Start doesn't signal the parent, so parentPID is 0 and
+// signaled is false. Where Start tells the parent through its readiness pipe instead, such as in a
+// process started by RestartN, signaled reports whether that succeeded.
+func (h *Hupd) StartInfo() (parentPID int, signaled bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.startInfo.parentPID, h.startInfo.signaled, h.startInfo.err
+}
+
+// StartedAt returns the time at which Start was called, or the zero time if it hasn't been.
+func (h *Hupd) StartedAt() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.startedAt
+}
+
+// Generation returns the number of times this process has been restarted, as passed to it by its
+// parent via the GenerationEnvKey environment variable. It is zero for a process that wasn't
+// started by a restart, and is only set once Start has been called.
+func (h *Hupd) Generation() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.generation
+}
+
+// FromRestart returns whether this process was started by a restart. This is true if the argument
+// at the Hupd's RestartArgIndex (the first argument after the program name, by default) is its
+// RestartArg (or "-restart" if RestartArg is empty) or one of its RestartArgAliases. If the Hupd's
+// DetectRestart field is set, its result is returned instead.
+func (h *Hupd) FromRestart() bool {
+	if h.DetectRestart != nil {
+		args := make([]string, len(os.Args))
+		copy(args, os.Args)
+		return h.DetectRestart(args)
+	}
 
-	if len(os.Args) > 1 {
-		args = make([]string, len(os.Args)+1)
-		copy(args[2:], os.Args[1:])
-		if args[2] == hupArg {
-			args = args[1:]
-		} else {
-			args[1] = hupArg
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	// Mirror restartArgs: an index past the end means the argument was appended.
+	pos := 1 + h.RestartArgIndex
+	if pos < 1 {
+		pos = 1
+	} else if pos >= len(os.Args) {
+		pos = len(os.Args) - 1
+	}
+	return h.isRestartArg(os.Args[pos])
+}
+
+// StartAuto is a convenience method for calling Start with the result of FromRestart.
+func (h *Hupd) StartAuto() error {
+	return h.Start(h.FromRestart())
+}
+
+// timeout returns a channel that receives once the Hupd's Timeout elapses. If there is no
+// Timeout, it returns nil so that it blocks forever on receive.
+func (h *Hupd) timeout() <-chan time.Time {
+	if h.Timeout <= 0 {
+		return nil
+	}
+	return h.clock().After(h.Timeout)
+}
+
+// prepared holds the functions returned by a PrepareProcess's Prepare method. Its methods may be
+// called on a nil *prepared, and only the first call to either has any effect.
+type prepared struct {
+	commitFn, rollbackFn func()
+	done                 bool
+}
+
+func (p *prepared) commit()   { p.finish(true) }
+func (p *prepared) rollback() { p.finish(false) }
+
+func (p *prepared) finish(commit bool) {
+	if p == nil || p.done {
+		return
+	}
+	p.done = true
+
+	fn := p.rollbackFn
+	if commit {
+		fn = p.commitFn
+	}
+	if fn != nil {
+		fn()
+	}
+}
+
+// beginRestart calls the Process's BeginRestart method, or its Prepare method if it implements
+// PrepareProcess, returning an ErrTimeout error if it doesn't return before the Hupd's Timeout
+// elapses or an ErrCanceled error if ctx is canceled. In either case, it may continue to run in the
+// background.
+//
+// If the Process implements PrepareProcess, the returned *prepared holds the functions returned by
+// Prepare. Otherwise, it is nil.
+func (h *Hupd) beginRestart(ctx context.Context, cmd *exec.Cmd) (*prepared, error) {
+	type result struct {
+		p   *prepared
+		err error
+	}
+
+	// The in-flight guard is released if BeginRestart times out, so a later restart could call it
+	// while an earlier call is still running. That would likely release resources twice, so it's
+	// refused.
+	if !atomic.CompareAndSwapInt32(&h.inBeginRestart, 0, 1) {
+		err := errors.New("BeginRestart is still running from an earlier restart")
+		return nil, &Error{ErrRestartInProgress, err}
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		defer atomic.StoreInt32(&h.inBeginRestart, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{nil, &Error{ErrPanic, fmt.Errorf("BeginRestart panicked: %v", r)}}
+			}
+		}()
+
+		if pp, ok := h.process().(PrepareProcess); ok {
+			commit, rollback, err := pp.Prepare(cmd)
+			if err != nil {
+				done <- result{nil, &Error{ErrRestart, err}}
+				return
+			}
+			done <- result{&prepared{commitFn: commit, rollbackFn: rollback}, nil}
+			return
+		}
+
+		if err := h.process().BeginRestart(cmd); err != nil {
+			done <- result{nil, &Error{ErrRestart, err}}
+			return
+		}
+		done <- result{}
+	}()
+
+	select {
+	case r := <-done:
+		return r.p, r.err
+	case <-h.timeout():
+		h.dumpStacks()
+		return nil, &Error{ErrTimeout, fmt.Errorf("%w: timed out", errBeginRestartAbandoned)}
+	case <-ctx.Done():
+		return nil, &Error{ErrCanceled, fmt.Errorf("%w: %w", errBeginRestartAbandoned, ctx.Err())}
+	}
+}
+
+// errBeginRestartAbandoned is wrapped by the error beginRestart returns if it stops waiting for
+// the Process's BeginRestart (or Prepare) method to return. The Process may have released its
+// resources by then, and it isn't resumed, so the process may be unable to continue.
+var errBeginRestartAbandoned = errors.New("BeginRestart did not return")
+
+// dumpStacks writes the stacks of all goroutines to the Hupd's Stderr (or os.Stderr, if nil) if
+// StackDumpOnTimeout is set.
+func (h *Hupd) dumpStacks() {
+	if !h.StackDumpOnTimeout {
+		return
+	}
+
+	var w io.Writer = os.Stderr
+	if h.Stderr != nil {
+		w = h.Stderr
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
 		}
-		args[0] = binpath
+		buf = make([]byte, len(buf)*2)
+	}
+
+	fmt.Fprintf(w, "huprt: restart timed out, goroutine stacks:\n%s\n", buf)
+}
+
+// resume calls the Process's ResumeAfterAbort method, if it implements Resumable, after a restart
+// fails with err. It returns err, or an ErrResume error wrapping both err and the error returned
+// by ResumeAfterAbort if resuming fails.
+func (h *Hupd) resume(err error) error {
+	r, ok := h.process().(Resumable)
+	if !ok {
+		return err
+	}
+
+	h.logf("huprt: resuming process after failed restart")
+	if rerr := r.ResumeAfterAbort(); rerr != nil {
+		return &Error{ErrResume, errors.Join(err, rerr)}
+	}
+	return err
+}
+
+// kill calls the Process's Kill method, or its KillErr method if it implements ErrProcess. If
+// KillErr returns an error, it is returned as an ErrKill error. If KillGrace is set, this process
+// is forcibly terminated once it elapses, whether or not Kill has returned. If Kill panics, the
+// panic is recovered and returned as an ErrPanic error.
+func (h *Hupd) kill() (err error) {
+	if h.KillGrace > 0 {
+		time.AfterFunc(h.KillGrace, forceExit)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{ErrPanic, fmt.Errorf("Kill panicked: %v", r)}
+		}
+	}()
+
+	if h.SyncOutput {
+		h.syncOutput()
+	}
+
+	h.logf("huprt: killing process")
+	if ep, ok := h.process().(ErrProcess); ok {
+		if err := ep.KillErr(); err != nil {
+			return &Error{ErrKill, err}
+		}
+	} else {
+		h.process().Kill()
+	}
+	if h.OnExit != nil {
+		h.OnExit()
+	}
+	if h.ExitOnKill {
+		os.Exit(h.ExitStatus)
+	}
+	return nil
+}
+
+// buildCmd creates and returns an exec.Cmd based on the initial program startup options
+// (i.e., cmd.Path is the program's executable and all arguments are passed through).
+//
+// If the Hupd's NextArgs field is set, the argument list is built from it by restartArgs.
+// Otherwise, if BuildArgs is set, it is used to build the argument list. If neither is set, the
+// arguments are built from os.Args by restartArgs.
+func (h *Hupd) buildCmd() *exec.Cmd {
+	var cmd = new(exec.Cmd)
+	var hupArg = h.restartArg()
+
+	cmd.Path = h.binary()
+	if len(h.NextArgs) > 0 {
+		cmd.Args = restartArgs(h.NextArgs, hupArg, h.RestartArgIndex, h.isRestartArg)
+	} else if h.BuildArgs != nil {
+		oldArgs := make([]string, len(os.Args))
+		copy(oldArgs, os.Args)
+		cmd.Args = h.BuildArgs(oldArgs, hupArg)
 	} else {
-		args = []string{binpath, hupArg}
+		cmd.Args = restartArgs(os.Args, hupArg, h.RestartArgIndex, h.isRestartArg)
+	}
+	// A detached process doesn't inherit this process's standard streams, since they may be the
+	// terminal it's being detached from. Leaving them nil connects them to the null device.
+	cmd.Stdin = h.Stdin
+	if cmd.Stdin == nil && h.InheritStdin && !h.Detach {
+		cmd.Stdin = os.Stdin
+	}
+	cmd.Stdout = h.Stdout
+	if cmd.Stdout == nil && !h.Detach {
+		cmd.Stdout = os.Stdout
+	}
+	cmd.Stderr = h.Stderr
+	if cmd.Stderr == nil && !h.Detach {
+		cmd.Stderr = os.Stderr
+	}
+
+	if h.TagOutput {
+		gen := envInt(h.generationEnvKey()) + 1
+		if cmd.Stdout != nil {
+			cmd.Stdout = newPrefixWriter(cmd.Stdout, gen)
+		}
+		if cmd.Stderr != nil {
+			cmd.Stderr = newPrefixWriter(cmd.Stderr, gen)
+		}
+	}
+
+	if h.SysProcAttr != nil {
+		// Copy the attributes so that setting options such as NewProcessGroup on the Cmd doesn't
+		// change the Hupd's.
+		attr := *h.SysProcAttr
+		cmd.SysProcAttr = &attr
+	}
+
+	cmd.Env = h.restartEnv()
+
+	cmd.Dir = h.WorkingDir
+	if cmd.Dir == "" {
+		// If this fails, cmd.Dir is left empty and the new process inherits the working directory
+		// anyway.
+		cmd.Dir, _ = os.Getwd()
 	}
 
-	cmd.Path = binpath
-	cmd.Args = args
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return cmd
+}
 
+// CurrentCmd returns the Cmd a restart would start the new process with if it were started now,
+// before the Process's BeginRestart method configures it, with the Hupd's configuration applied.
+// Nothing is restarted. This is useful for displaying the command line of the next generation, or
+// for testing how the arguments are built.
+func (h *Hupd) CurrentCmd() *exec.Cmd {
+	cmd := h.buildCmd()
+	// On platforms without process attribute support, the error is reported by Restart instead.
+	h.setProcAttr(cmd)
 	return cmd
 }
 
-// NotifyRestart waits for a SIGHUP and, once-received, attempts to restart the process. Returns
-// any error that occurs. This function is intended to be run in a separate goroutine, as it will
-// block until a SIGHUP is received.
+// launchExecutable is the absolute path of the program's executable, resolved when the program
+// starts so that it isn't affected by later changes to the working directory or PATH.
+var launchExecutable = resolveExecutable()
+
+// resolveExecutable returns the absolute path the program was invoked by, found by looking up
+// os.Args[0], falling back to os.Executable. Symlinks aren't evaluated, so a restart starts
+// whatever the path refers to at the time, such as after a deploy flips a symlink to a new
+// release. os.Executable isn't preferred because it may return the file that's already running
+// (on Linux, the target of /proc/self/exe) rather than what's now at the invoked path. If both
+// fail, it returns os.Args[0].
+func resolveExecutable() string {
+	if path, ok := lookupArg0(); ok {
+		return path
+	}
+	if exe, err := os.Executable(); err == nil {
+		return exe
+	}
+	if len(os.Args) == 0 {
+		return ""
+	}
+	return os.Args[0]
+}
+
+// lookupArg0 returns the absolute path of os.Args[0], looking it up in PATH if it doesn't contain
+// a path separator. Symlinks aren't evaluated.
+func lookupArg0() (string, bool) {
+	if len(os.Args) == 0 {
+		return "", false
+	}
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	return abs, true
+}
+
+// binary returns the path of the executable to start for a restart: the Hupd's Binary, if set, or
+// the program's executable. If UpgradeInPlace is set and the program was invoked by a bare name,
+// the name is looked up in PATH again instead of using the path resolved when the program started.
+func (h *Hupd) binary() string {
+	if h.Binary != "" {
+		return h.Binary
+	}
+	if h.UpgradeInPlace && len(os.Args) > 0 && !strings.ContainsRune(os.Args[0], filepath.Separator) {
+		if path, ok := lookupArg0(); ok {
+			return path
+		}
+	}
+	return launchExecutable
+}
+
+// restartArgs returns a new argument list, including the program name, for a restarting process
+// based on the current process's arguments, oldArgs.
+//
+// All existing occurrences of the restart argument, as determined by isHupArg, are removed, and
+// then hupArg is inserted at index (counting from the first argument after the program name). If
+// index is past the end of the remaining arguments, hupArg is appended. As a result, the
+// arguments for a restarting process should always be predictable both for the new process and
+// the Hupd process's BeginRestart method, and don't grow across successive restarts.
+func restartArgs(oldArgs []string, hupArg string, index int, isHupArg func(string) bool) []string {
+	args := make([]string, 1, len(oldArgs)+1)
+	args[0] = oldArgs[0]
+	for _, arg := range oldArgs[1:] {
+		if !isHupArg(arg) {
+			args = append(args, arg)
+		}
+	}
+
+	pos := 1 + index
+	if pos < 1 {
+		pos = 1
+	} else if pos > len(args) {
+		pos = len(args)
+	}
+
+	args = append(args, "")
+	copy(args[pos+1:], args[pos:])
+	args[pos] = hupArg
+	return args
+}
+
+// NotifyRestart waits for a SIGHUP (or the Hupd's RestartSignal, if set) and, once-received,
+// attempts to restart the process. Returns any error that occurs. This function is intended to be
+// run in a separate goroutine, as it will block until the signal is received.
+//
+// If the restart signal is the same as the kill or ready signal, NotifyRestart returns an
+// ErrSignalConflict error without waiting for a signal.
 //
 // It is effectively a convenience function for calling signal.Notify, waiting for a signal, and
-// calling the Hupd Restart method.
+// calling the Hupd Restart method. If the Hupd's ReloadFunc field is set, the signal may reload the
+// process instead, in which case NotifyRestart continues waiting for the signal.
 func (h *Hupd) NotifyRestart() error {
-	hup := make(chan os.Signal, 1)
-	signal.Notify(hup, unix.SIGHUP)
+	hup, err := h.notifyRestartSignal()
+	if err != nil {
+		return err
+	}
 	defer signal.Stop(hup)
 
-	<-hup
-	return h.Restart()
+	return h.NotifyRestartChan(hup)
+}
+
+// NotifyRestartChan waits for a signal to be received on ch and then attempts to restart the
+// process, returning any error that occurs. This is useful if signal.Notify is called elsewhere in
+// the program. If ch is closed, NotifyRestartChan returns nil without restarting.
+func (h *Hupd) NotifyRestartChan(ch <-chan os.Signal) error {
+	done := h.done()
+	if isDone(done) {
+		return &Error{ErrStopped, nil}
+	}
+
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return nil
+			}
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+		if reloaded, err := h.reload(); reloaded {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		return h.Restart()
+	}
+}
+
+// NotifyRestartContext is similar to NotifyRestart, except that it stops waiting for the restart
+// signal if ctx is canceled, returning an ErrCanceled error wrapping ctx.Err() without restarting.
+// If the signal is received, the restart is performed using RestartContext with ctx.
+func (h *Hupd) NotifyRestartContext(ctx context.Context) error {
+	hup, err := h.notifyRestartSignal()
+	if err != nil {
+		return err
+	}
+	defer signal.Stop(hup)
+
+	done := h.done()
+	for {
+		select {
+		case <-hup:
+		case <-ctx.Done():
+			return &Error{ErrCanceled, ctx.Err()}
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+		if reloaded, err := h.reload(); reloaded {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		return h.RestartContext(ctx)
+	}
+}
+
+// NotifyRestartStop is similar to NotifyRestart, except that it returns nil without restarting if
+// stop is closed before the restart signal is received.
+func (h *Hupd) NotifyRestartStop(stop <-chan struct{}) error {
+	hup, err := h.notifyRestartSignal()
+	if err != nil {
+		return err
+	}
+	defer signal.Stop(hup)
+
+	done := h.done()
+	for {
+		select {
+		case <-hup:
+		case <-stop:
+			return nil
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+		if reloaded, err := h.reload(); reloaded {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		return h.Restart()
+	}
+}
+
+// NotifyRestartLoop is similar to NotifyRestart, except that it continues to wait for restart
+// signals after a restart fails. Each time a restart fails, onErr is called with the error. If
+// onErr returns true, NotifyRestartLoop waits for the next signal. Otherwise, it returns the error.
+// If onErr is nil, the first error is returned.
+//
+// If the Hupd's CoalesceWindow is set, restart signals received within the window after the first
+// are collapsed into a single restart. Signals received during a restart are always collapsed into
+// at most one subsequent restart.
+//
+// NotifyRestartLoop returns nil once a restart succeeds. If the Hupd's ReloadFunc field is set and
+// the signal reloads the process instead, NotifyRestartLoop continues waiting, and any error from
+// ReloadFunc is passed to onErr like a failed restart.
+func (h *Hupd) NotifyRestartLoop(onErr func(error) bool) error {
+	hup, err := h.notifyRestartSignal()
+	if err != nil {
+		return err
+	}
+	defer signal.Stop(hup)
+
+	done := h.done()
+	for {
+		select {
+		case <-hup:
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+		if err := h.coalesce(hup, done); err != nil {
+			return err
+		}
+
+		reloaded, err := h.reload()
+		if !reloaded {
+			err = h.Restart()
+			if err == nil {
+				return nil
+			}
+		}
+		if err != nil && (onErr == nil || !onErr(err)) {
+			return err
+		}
+	}
+}
+
+// Stop permanently stops restart handling. Any NotifyRestart call (or variant) waiting for a
+// restart signal returns an ErrStopped error without restarting, as do any later calls. A restart
+// already in progress is not interrupted; use RestartContext to cancel one. It is safe to call Stop
+// more than once and from multiple goroutines.
+func (h *Hupd) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped == nil {
+		h.stopped = make(chan struct{})
+	}
+	if !isDone(h.stopped) {
+		close(h.stopped)
+	}
+}
+
+// done returns a channel that's closed once Stop is called.
+func (h *Hupd) done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stopped == nil {
+		h.stopped = make(chan struct{})
+	}
+	return h.stopped
+}
+
+// isDone reports whether done is closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// coalesce waits for the Hupd's CoalesceWindow to elapse, discarding any signals received on hup in
+// the meantime. If done is closed first, it returns an ErrStopped error.
+func (h *Hupd) coalesce(hup <-chan os.Signal, done <-chan struct{}) error {
+	if h.CoalesceWindow <= 0 {
+		return nil
+	}
+
+	elapsed := h.clock().After(h.CoalesceWindow)
+	for {
+		select {
+		case <-hup:
+		case <-elapsed:
+			return nil
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+	}
+}
+
+// TriggerRestart tells the process identified by pid to restart by sending it a SIGHUP. This is
+// useful for tools and tests controlling a program using NotifyRestart. If the program uses a
+// different RestartSignal, use TriggerRestartSignal instead.
+func TriggerRestart(pid int) error {
+	return TriggerRestartSignal(pid, syscall.SIGHUP)
+}
+
+// TriggerRestartSignal tells the process identified by pid to restart by sending it sig. Any error
+// is returned as an ErrTrigger error.
+func TriggerRestartSignal(pid int, sig syscall.Signal) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return &Error{ErrTrigger, err}
+	}
+	if err := p.Signal(sig); err != nil {
+		return &Error{ErrTrigger, err}
+	}
+	return nil
+}
+
+// notifyRestartSignal returns a channel that receives the Hupd's restart signal. The caller must
+// pass the channel to signal.Stop once done with it. If the restart and kill signals are the same,
+// it returns an ErrSignalConflict error. If the Hupd has been stopped, it returns an ErrStopped
+// error.
+func (h *Hupd) notifyRestartSignal() (chan os.Signal, error) {
+	if h.signalConflict() {
+		return nil, &Error{ErrSignalConflict, nil}
+	}
+	if isDone(h.done()) {
+		return nil, &Error{ErrStopped, nil}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, h.restartSignal())
+	return hup, nil
 }
 
 // Restart tells Hupd to restart this process. If the Hupd's RestartArg field is empty, the restart
 // argument passed to the new process defaults to "-restart". It is assumed to always be the first
-// argument. As such, only the first argument is checked for it. If it's not the first argument, it
-// is prepended to the argument list passed to the new process.
+// argument (or at RestartArgIndex, if set). Any other occurrences of it are removed from the
+// argument list passed to the new process, so it appears exactly once.
+//
+// Before BeginRestart is called, the Cmd's Path is checked to ensure it refers to an executable
+// file. If not, an ErrNewProcess error is returned without calling BeginRestart, so no resources
+// are released for a restart that can't succeed. Since BeginRestart may change the Cmd, the check
+// is repeated after it returns, before attempting to start the new process.
+//
+// The Hupd's Timeout, if set, applies separately to both the Process's BeginRestart method and to
+// waiting for the new process to send the KillSignal. If BeginRestart times out, an ErrTimeout
+// error is returned, but BeginRestart may still be running in the background, since it can't be
+// stopped. In that case, the Process is likely in an inconsistent state. If waiting for the new
+// process times out, the error wraps a *ChildError holding the new process's PID, since it may
+// still be running.
+//
+// Only one restart may be in progress at a time. If Restart is called while another restart is in
+// progress, it returns an ErrRestartInProgress error immediately. BeginRestart is also never called
+// while an earlier call is still running (for example, after an earlier restart timed out waiting
+// for it); Restart returns an ErrRestartInProgress error instead.
+//
+// If the new process exits before sending the KillSignal, Restart returns an ErrChildExited error
+// wrapping the error returned by the Cmd's Wait method (usually an *exec.ExitError). The Kill
+// method is not called in that case.
+//
+// If the restart fails after BeginRestart has returned successfully and the Process implements
+// Resumable, its ResumeAfterAbort method is called before Restart returns.
+//
+// If BeginRestart or Kill panics, the panic is recovered and Restart returns an ErrPanic error
+// describing it. A Process that panics in Kill is not resumed, since the new process has already
+// taken over.
 func (h *Hupd) Restart() error {
-	if h.Process == nil {
-		return &Error{ErrNoProcess, nil}
+	return h.RestartContext(context.Background())
+}
+
+// RestartNow restarts the process immediately, without waiting for a restart signal. It's intended
+// to be called manually, such as from an admin endpoint or command, and behaves the same as
+// Restart. In particular, if a restart is already in progress (for example, one started by
+// NotifyRestart), RestartNow returns an ErrRestartInProgress error without restarting.
+func (h *Hupd) RestartNow() error {
+	return h.Restart()
+}
+
+// RestartContext behaves the same as Restart, except that it stops waiting for BeginRestart or for
+// the new process to send its KillSignal if ctx is canceled. When that happens, the returned error
+// has the ErrCanceled code and wraps ctx.Err(). If the new process had already been started, it
+// wraps ctx.Err() in a *ChildError holding the new process's PID. The Process's Kill method is not
+// called if ctx is canceled.
+func (h *Hupd) RestartContext(ctx context.Context) error {
+	_, err := h.restartContext(ctx, new(RestartResult))
+	return err
+}
+
+// RestartCmd behaves the same as Restart, but also returns the Cmd used to start the new process.
+// The Cmd is returned if the new process was started, even if an error occurs afterward (such as
+// a timeout), and is nil otherwise.
+//
+// The Hupd waits on the new process itself, so the Cmd's Wait method must not be called. Its
+// Process field can be used to inspect or signal the new process. Supervisors that need to know
+// when the new process exits, in place of calling Wait, should set the Hupd's OnChildExit field,
+// which is passed the process's state once it exits. The Cmd's ProcessState field is only safe to
+// read once OnChildExit has been called.
+func (h *Hupd) RestartCmd() (*exec.Cmd, error) {
+	return h.restartContext(context.Background(), new(RestartResult))
+}
+
+// RestartResult describes a restart performed by RestartWithResult.
+type RestartResult struct {
+	// PID is the new process's PID, or 0 if it wasn't started.
+	PID int
+	// BeginRestart is the time spent in the Process's BeginRestart method.
+	BeginRestart time.Duration
+	// Handshake is the time spent waiting for the new process to complete the handshake.
+	Handshake time.Duration
+	// TimedOut is true if the restart failed because of a timeout.
+	TimedOut bool
+
+	// released is true if the Process's BeginRestart method returned successfully, so it may have
+	// released its resources.
+	released bool
+}
+
+// RestartWithResult behaves the same as Restart, but also returns a RestartResult describing the
+// restart. The result is filled in as far as the restart got, even if an error is returned.
+func (h *Hupd) RestartWithResult() (RestartResult, error) {
+	var res RestartResult
+	_, err := h.restartContext(context.Background(), &res)
+	return res, err
+}
+
+func (h *Hupd) restartContext(ctx context.Context, res *RestartResult) (*exec.Cmd, error) {
+	if !atomic.CompareAndSwapInt32(&h.restarting, 0, 1) {
+		return nil, &Error{ErrRestartInProgress, nil}
 	}
+	defer atomic.StoreInt32(&h.restarting, 0)
 
-	arg := h.RestartArg
-	if len(arg) == 0 {
-		arg = "-restart"
+	if err := h.limitRestart(); err != nil {
+		h.logf("huprt: restart refused: %v", err)
+		return nil, err
 	}
 
-	cmd := restartCmd(arg)
+	h.restarts.Add(1)
+	ctx, cancel := h.withDeadline(ctx)
+	defer cancel()
 
-	if err := h.Process.BeginRestart(&cmd); err != nil {
-		return &Error{ErrRestart, err}
+	start := time.Now()
+	cmd, err := h.restart(ctx, res)
+	err = deadlineErr(ctx, err)
+	res.TimedOut = errors.Is(err, ErrTimeoutSentinel)
+	if err != nil {
+		h.logf("huprt: restart failed: %v", err)
+	}
+	if h.OnRestartComplete != nil {
+		h.OnRestartComplete(time.Since(start), err)
 	}
+	return cmd, err
+}
 
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, unix.SIGTERM)
-	defer signal.Stop(sig)
+// errDeadline is the cause of the context returned by withDeadline once the Deadline passes.
+var errDeadline = errors.New("restart deadline exceeded")
 
-	if err := cmd.Start(); err != nil {
-		return &Error{ErrNewProcess, err}
+// withDeadline returns a copy of ctx that's canceled once the Hupd's Deadline elapses, if set.
+func (h *Hupd) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.Deadline <= 0 {
+		return ctx, func() {}
 	}
+	return context.WithTimeoutCause(ctx, h.Deadline, errDeadline)
+}
 
-	// Default to nil so it blocks forever on receive, unless there's a defined timeout.
-	var timeout <-chan time.Time
-	if h.Timeout > 0 {
-		timeout = time.After(h.Timeout)
+// deadlineErr returns err as an ErrTimeout error if it's an ErrCanceled error caused by ctx
+// passing the Hupd's Deadline. Otherwise, it returns err.
+func deadlineErr(ctx context.Context, err error) error {
+	e, ok := err.(*Error)
+	if !ok || e.Code != ErrCanceled || context.Cause(ctx) != errDeadline {
+		return err
 	}
+	return &Error{ErrTimeout, e.Inner}
+}
 
+// limitRestart records a restart attempt, or returns an ErrRateLimited error if the Hupd's
+// MaxRestarts have already been attempted within its RestartWindow.
+func (h *Hupd) limitRestart() error {
+	if h.MaxRestarts <= 0 || h.RestartWindow <= 0 {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-h.RestartWindow)
+	i := 0
+	for i < len(h.recent) && !h.recent[i].After(cutoff) {
+		i++
+	}
+	h.recent = append(h.recent[:0], h.recent[i:]...)
+
+	if len(h.recent) >= h.MaxRestarts {
+		err := fmt.Errorf("%d restarts within %v", len(h.recent), h.RestartWindow)
+		return &Error{ErrRateLimited, err}
+	}
+	h.recent = append(h.recent, now)
+	return nil
+}
+
+// Restarting returns whether a restart (or a call to Validate) is currently in progress.
+func (h *Hupd) Restarting() bool {
+	return atomic.LoadInt32(&h.restarting) != 0
+}
+
+// RestartCount returns the number of restarts attempted by the Hupd, including failed restarts.
+// Restarts rejected because another restart was in progress are not counted.
+func (h *Hupd) RestartCount() uint64 {
+	return h.restarts.Load()
+}
+
+// forwardSignals sends any of the Hupd's ForwardSignals received by this process to proc until the
+// returned function is called.
+func (h *Hupd) forwardSignals(proc *os.Process) func() {
+	sigs := make([]os.Signal, 0, len(h.ForwardSignals))
+	for _, s := range h.ForwardSignals {
+		if s != h.readySignal() || h.readyPipe() {
+			sigs = append(sigs, s)
+		}
+	}
+	if len(sigs) == 0 {
+		return func() {}
+	}
+
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case s := <-ch:
+				h.logf("huprt: forwarding %v to new process %d", s, proc.Pid)
+				if err := proc.Signal(s); err != nil {
+					h.logf("huprt: error forwarding %v: %v", s, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// notifyCancel returns a channel that receives any of the Hupd's CancelSignals, and a function that
+// must be called once the channel is no longer needed. The ReadySignal is never included.
+func (h *Hupd) notifyCancel() (<-chan os.Signal, func()) {
+	sigs := h.CancelSignals
+	if sigs == nil {
+		sigs = []syscall.Signal{syscall.SIGINT}
+	}
+
+	watch := make([]os.Signal, 0, len(sigs))
+	for _, s := range sigs {
+		if s != h.readySignal() {
+			watch = append(watch, s)
+		}
+	}
+	if len(watch) == 0 {
+		return nil, func() {}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, watch...)
+	return ch, func() { signal.Stop(ch) }
+}
+
+func (h *Hupd) restart(ctx context.Context, res *RestartResult) (cmd *exec.Cmd, err error) {
+	if h.process() == nil {
+		return nil, &Error{ErrNoProcess, nil}
+	}
+	if err := h.validateRestartArg(); err != nil {
+		return nil, err
+	}
+
+	cmd = h.buildCmd()
+	if args := nextArgs(ctx); args != nil {
+		cmd.Args = restartArgs(args, h.restartArg(), h.RestartArgIndex, h.isRestartArg)
+	}
+	if err := h.setProcAttr(cmd); err != nil {
+		return nil, err
+	}
+
+	// Check the executable before BeginRestart releases any resources, so that a missing binary
+	// (for example, mid-deploy) doesn't leave the process without them.
+	if err := validateCmd(cmd); err != nil {
+		return nil, &Error{ErrNewProcess, err}
+	}
+
+	// Handle the ReadySignal before calling BeginRestart so there's no window where only the
+	// program's own handlers would receive it. If the new process uses a readiness pipe instead,
+	// the ReadySignal isn't handled, so that one sent for another reason, such as a SIGTERM from
+	// a service manager, still reaches the program.
+	var killed <-chan os.Signal
+	if !h.readyPipe() {
+		sig, stopKilled, err := h.notifyKill(cmd)
+		if err != nil {
+			return nil, &Error{ErrNewProcess, err}
+		}
+		defer stopKilled()
+		killed = sig
+	}
+
+	h.logf("huprt: beginning restart: %q", cmd.Args)
+	begin := time.Now()
+	prep, err := h.beginRestart(ctx, cmd)
+	res.BeginRestart = time.Since(begin)
+	// Close any files huprt created for the Cmd, such as by PassFD, once it's no longer needed.
+	owner := cmd
+	defer closeOwnedFiles(owner)
+	if err != nil {
+		return nil, err
+	}
+	res.released = true
+
+	// From here on, the Process has released its resources and must be resumed (or, if it was
+	// prepared and not yet committed, rolled back) if the restart fails before the new process
+	// takes over.
+	handedOff := false
+	defer func() {
+		if err == nil || handedOff {
+			return
+		}
+		// Close the duplicates of any passed listeners first, so the Process can listen again.
+		closeOwnedFiles(owner)
+		if prep != nil && !prep.done {
+			h.logf("huprt: rolling back process after failed restart")
+			prep.rollback()
+			return
+		}
+		err = h.resume(err)
+	}()
+
+	if err := validateCmd(cmd); err != nil {
+		return nil, &Error{ErrNewProcess, err}
+	}
+
+	passed, err := passListeners(cmd)
+	if err != nil {
+		return nil, err
+	}
+	// The new process has its own copies once started, and this process keeps the listeners.
+	defer closeFiles(passed)
+
+	statePath, err := h.passState(cmd)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		// Once started, the new process is responsible for removing the state file.
+		if statePath != "" && !started {
+			os.Remove(statePath)
+		}
+	}()
+
+	if h.InspectCmd != nil {
+		if err := h.InspectCmd(cmd); err != nil {
+			return nil, &Error{ErrNewProcess, err}
+		}
+	}
+
+	setFDEnv(cmd)
+
+	// The handshake is complete once either the KillSignal is received or, if using a readiness
+	// pipe, the new process signals that it's ready. Only one of these is non-nil.
+	var ready <-chan map[string]string
+	var readyW *os.File
+	if h.readyPipe() {
+		if !h.ReadyPipe {
+			// Have Start in the new process use the pipe in place of the ReadySignal.
+			setCmdEnv(cmd, readyOnStartEnvKey, "1")
+		}
+
+		r, w, err := readyPipe(cmd)
+		if err != nil {
+			return nil, &Error{ErrNewProcess, err}
+		}
+		defer r.Close()
+
+		ready = waitReady(r)
+		readyW = w
+	}
+
+	cmd, err = h.startCmd(cmd)
+	if readyW != nil {
+		// Only the new process needs the write end of the pipe.
+		readyW.Close()
+	}
+	if err != nil {
+		return nil, &Error{ErrNewProcess, err}
+	}
+
+	started = true
+	prep.commit()
+	res.PID = cmd.Process.Pid
+	h.logf("huprt: started new process %d", cmd.Process.Pid)
+	if h.OnSpawn != nil {
+		h.OnSpawn(cmd.Process.Pid)
+	}
+
+	stopForwarding := h.forwardSignals(cmd.Process)
+
+	// Wait on the new process in case it exits before completing the handshake. This also reaps
+	// the new process if it's left running after a failed restart.
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		if h.OnChildExit != nil {
+			h.OnChildExit(cmd.ProcessState)
+		}
+	}()
+
+	childExited := false
+	killChild := h.KillChildOnFailure
+	defer func() {
+		if err == nil || handedOff || childExited || !killChild {
+			return
+		}
+		h.logf("huprt: killing new process %d after failed restart", cmd.Process.Pid)
+		if kerr := cmd.Process.Kill(); kerr != nil {
+			h.logf("huprt: error killing new process %d: %v", cmd.Process.Pid, kerr)
+			return
+		}
+		<-exited
+	}()
+
+	cancel, stopCancel := h.notifyCancel()
+	defer stopCancel()
+
+	handshake := time.Now()
+	timeout := h.timeout()
+	var status map[string]string
 	select {
-	case <-sig:
-		h.Process.Kill()
+	case s := <-killed:
+		h.logf("huprt: received %v from new process", s)
+	case status = <-ready:
+		h.logf("huprt: new process is ready")
 	case <-timeout:
-		return &Error{ErrTimeout, nil}
+		h.dumpStacks()
+		err = &Error{ErrTimeout, &ChildError{PID: cmd.Process.Pid}}
+	case <-ctx.Done():
+		err = &Error{ErrCanceled, &ChildError{cmd.Process.Pid, ctx.Err()}}
+	case s := <-cancel:
+		// A cancel signal means the operator wants everything to stop, so don't leave the new
+		// process running.
+		killChild = true
+		err = &Error{ErrCanceled, &ChildError{cmd.Process.Pid, fmt.Errorf("received %v", s)}}
+	case werr := <-exited:
+		childExited = true
+		err = &Error{ErrChildExited, werr}
+	}
+	res.Handshake = time.Since(handshake)
+	stopForwarding()
+	if err != nil {
+		return cmd, err
+	}
+	if h.OnReady != nil {
+		h.OnReady(status)
 	}
 
-	return nil
+	if h.HealthCheck != nil {
+		if err := h.HealthCheck(); err != nil {
+			return cmd, &Error{ErrUnhealthy, err}
+		}
+	}
+
+	handedOff = true
+	return cmd, h.kill()
 }
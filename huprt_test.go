@@ -0,0 +1,117 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRestartArgs(t *testing.T) {
+	h := &Hupd{RestartArgAliases: []string{"--restart", "-hup"}}
+
+	tests := []struct {
+		name  string
+		args  []string
+		index int
+		want  []string
+	}{
+		{
+			name: "no args",
+			args: []string{"prog"},
+			want: []string{"prog", "-restart"},
+		},
+		{
+			name: "prepended",
+			args: []string{"prog", "-v", "serve"},
+			want: []string{"prog", "-restart", "-v", "serve"},
+		},
+		{
+			name: "existing arg removed",
+			args: []string{"prog", "-v", "-restart", "serve"},
+			want: []string{"prog", "-restart", "-v", "serve"},
+		},
+		{
+			name: "duplicates removed",
+			args: []string{"prog", "-restart", "-v", "-restart", "serve", "-restart"},
+			want: []string{"prog", "-restart", "-v", "serve"},
+		},
+		{
+			name: "aliases removed",
+			args: []string{"prog", "--restart", "-v", "-hup", "serve"},
+			want: []string{"prog", "-restart", "-v", "serve"},
+		},
+		{
+			name:  "index",
+			args:  []string{"prog", "serve", "-v"},
+			index: 1,
+			want:  []string{"prog", "serve", "-restart", "-v"},
+		},
+		{
+			name:  "index at end",
+			args:  []string{"prog", "serve", "-v"},
+			index: 2,
+			want:  []string{"prog", "serve", "-v", "-restart"},
+		},
+		{
+			name:  "index past end",
+			args:  []string{"prog", "serve"},
+			index: 5,
+			want:  []string{"prog", "serve", "-restart"},
+		},
+		{
+			name:  "index past end after removal",
+			args:  []string{"prog", "serve", "-restart"},
+			index: 2,
+			want:  []string{"prog", "serve", "-restart"},
+		},
+		{
+			name:  "negative index",
+			args:  []string{"prog", "serve"},
+			index: -1,
+			want:  []string{"prog", "-restart", "serve"},
+		},
+		{
+			name: "similar args kept",
+			args: []string{"prog", "-restarts", "-restart=1"},
+			want: []string{"prog", "-restart", "-restarts", "-restart=1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := restartArgs(tt.args, h.restartArg(), tt.index, h.isRestartArg)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restartArgs(%q, %d) = %q; want %q", tt.args, tt.index, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartArgsRepeated(t *testing.T) {
+	h := &Hupd{RestartArgAliases: []string{"--restart"}}
+
+	for _, index := range []int{0, 1, 10} {
+		args := []string{"prog", "--restart", "serve", "-v"}
+		want := restartArgs(args, h.restartArg(), index, h.isRestartArg)
+		args = want
+		// Each restart passes the previous restart's arguments to the next, which must not grow.
+		for i := 0; i < 5; i++ {
+			args = restartArgs(args, h.restartArg(), index, h.isRestartArg)
+			if !reflect.DeepEqual(args, want) {
+				t.Fatalf("index %d: restart %d: args = %q; want %q", index, i+1, args, want)
+			}
+		}
+	}
+}
+
+func TestRestartArgsDoesNotModifyInput(t *testing.T) {
+	h := &Hupd{}
+	args := []string{"prog", "-restart", "serve"}
+	restartArgs(args, h.restartArg(), 1, h.isRestartArg)
+	if want := []string{"prog", "-restart", "serve"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("restartArgs modified its input: %q; want %q", args, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+// Package huprttest provides utilities for testing programs that use huprt without starting real
+// processes.
+package huprttest
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/nilium/huprt"
+)
+
+// FakeHupd simulates the restart handshake performed by a huprt.Hupd within a single process.
+// Instead of starting a new process, its Restart method calls Child in a new goroutine. Each
+// restart is recorded so that tests can check that BeginRestart was called, how the Cmd was
+// configured, whether the handshake completed, and whether Kill was called.
+//
+// Errors returned by Restart are *huprt.Error values with the same codes a huprt.Hupd would
+// return in the same situation.
+//
+// As with a huprt.Hupd, if Process is nil, huprt.DefaultProcess is used unless RequireProcess is
+// set, so Kill exits the program once a restart succeeds.
+type FakeHupd struct {
+	huprt.Process
+
+	RestartArg     string
+	Timeout        time.Duration
+	RequireProcess bool
+
+	// NewCmd, if set, returns the Cmd passed to BeginRestart, such as a huprt.Hupd's CurrentCmd
+	// method. If nil, the Cmd runs os.Args[0] with RestartArg (or "-restart") prepended to the
+	// program's arguments.
+	NewCmd func() *exec.Cmd
+
+	// Child, if set, is called in a new goroutine in place of starting the new process. It is
+	// passed the Cmd configured by BeginRestart and a function, ready, that completes the
+	// handshake (as the new process does by calling huprt.Hupd's Start method). If Child returns
+	// before calling ready, the restart fails as though the new process exited. If nil, the
+	// handshake completes immediately.
+	Child func(cmd *exec.Cmd, ready func()) error
+
+	mu       sync.Mutex
+	restarts []Restart
+}
+
+// Restart records what happened during a call to FakeHupd's Restart method.
+type Restart struct {
+	// Cmd is the Cmd passed to BeginRestart.
+	Cmd *exec.Cmd
+	// Began is true if BeginRestart returned successfully.
+	Began bool
+	// Ready is true if the child completed the handshake.
+	Ready bool
+	// Killed is true if the Process's Kill method was called.
+	Killed bool
+	// Err is the error returned by Restart, if any.
+	Err error
+}
+
+// Restarts returns the restarts performed so far, in order.
+func (f *FakeHupd) Restarts() []Restart {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Restart(nil), f.restarts...)
+}
+
+// update applies fn to the record of the restart at index i.
+func (f *FakeHupd) update(i int, fn func(*Restart)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.restarts[i])
+}
+
+// Restart simulates a restart. It calls the Process's BeginRestart method, runs Child, waits for
+// it to complete the handshake, and then calls the Process's Kill method.
+func (f *FakeHupd) Restart() (err error) {
+	p := f.process()
+	if p == nil {
+		return &huprt.Error{Code: huprt.ErrNoProcess}
+	}
+
+	cmd := f.newCmd()
+	f.mu.Lock()
+	i := len(f.restarts)
+	f.restarts = append(f.restarts, Restart{Cmd: cmd})
+	f.mu.Unlock()
+	defer func() { f.update(i, func(r *Restart) { r.Err = err }) }()
+
+	if err := p.BeginRestart(cmd); err != nil {
+		return &huprt.Error{Code: huprt.ErrRestart, Inner: err}
+	}
+	f.update(i, func(r *Restart) { r.Began = true })
+
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	signalReady := func() { readyOnce.Do(func() { close(ready) }) }
+
+	exited := make(chan error, 1)
+	go func() {
+		if f.Child == nil {
+			signalReady()
+			exited <- nil
+			return
+		}
+		exited <- f.Child(cmd, signalReady)
+	}()
+
+	var timeout <-chan time.Time
+	if f.Timeout > 0 {
+		timeout = time.After(f.Timeout)
+	}
+
+	select {
+	case <-ready:
+	case <-timeout:
+		return &huprt.Error{Code: huprt.ErrTimeout}
+	case err := <-exited:
+		// The child may have completed the handshake before returning.
+		select {
+		case <-ready:
+		default:
+			if err == nil {
+				err = errors.New("child returned before completing the handshake")
+			}
+			return &huprt.Error{Code: huprt.ErrChildExited, Inner: err}
+		}
+	}
+	f.update(i, func(r *Restart) { r.Ready = true })
+
+	p.Kill()
+	f.update(i, func(r *Restart) { r.Killed = true })
+	return nil
+}
+
+// process returns the Process to restart, as a huprt.Hupd would choose it.
+func (f *FakeHupd) process() huprt.Process {
+	if f.Process == nil && !f.RequireProcess {
+		return huprt.DefaultProcess
+	}
+	return f.Process
+}
+
+func (f *FakeHupd) newCmd() *exec.Cmd {
+	if f.NewCmd != nil {
+		return f.NewCmd()
+	}
+
+	arg := f.RestartArg
+	if arg == "" {
+		arg = "-restart"
+	}
+	args := append([]string{arg}, os.Args[1:]...)
+	return exec.Command(os.Args[0], args...)
+}
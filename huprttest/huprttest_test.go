@@ -0,0 +1,129 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprttest
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/nilium/huprt"
+)
+
+// process is a huprt.Process that records calls to its methods.
+type process struct {
+	beginErr error
+	began    int
+	killed   int
+}
+
+func (p *process) BeginRestart(*exec.Cmd) error {
+	p.began++
+	return p.beginErr
+}
+
+func (p *process) Kill() { p.killed++ }
+
+func TestRestart(t *testing.T) {
+	p := &process{}
+	f := &FakeHupd{Process: p}
+
+	if err := f.Restart(); err != nil {
+		t.Fatalf("Restart() error = %v", err)
+	}
+	if p.began != 1 || p.killed != 1 {
+		t.Errorf("BeginRestart called %d times, Kill %d times; want 1 each", p.began, p.killed)
+	}
+
+	rs := f.Restarts()
+	if len(rs) != 1 {
+		t.Fatalf("len(Restarts()) = %d; want 1", len(rs))
+	}
+	if r := rs[0]; !r.Began || !r.Ready || !r.Killed || r.Err != nil {
+		t.Errorf("Restarts()[0] = %+v; want a completed restart", r)
+	}
+	if got := rs[0].Cmd.Args; len(got) < 2 || got[1] != "-restart" {
+		t.Errorf("Cmd.Args = %q; want the restart argument first", got)
+	}
+}
+
+func TestRestartRequireProcess(t *testing.T) {
+	f := &FakeHupd{RequireProcess: true}
+	if err := f.Restart(); !errors.Is(err, huprt.ErrNoProcessSentinel) {
+		t.Errorf("Restart() error = %v; want an ErrNoProcess error", err)
+	}
+}
+
+func TestRestartDefaultProcess(t *testing.T) {
+	// DefaultProcess exits the program in Kill, so only check that it's used up to the handshake.
+	f := &FakeHupd{Child: func(*exec.Cmd, func()) error { return nil }}
+	if err := f.Restart(); !errors.Is(err, huprt.ErrChildExitedSentinel) {
+		t.Errorf("Restart() error = %v; want an ErrChildExited error", err)
+	}
+	if r := f.Restarts()[0]; !r.Began {
+		t.Error("DefaultProcess's BeginRestart wasn't called")
+	}
+}
+
+func TestRestartErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		p      *process
+		child  func(*exec.Cmd, func()) error
+		want   *huprt.Error
+		killed bool
+	}{
+		{
+			name: "BeginRestart",
+			p:    &process{beginErr: errors.New("busy")},
+			want: huprt.ErrRestartSentinel,
+		},
+		{
+			name:  "child exited",
+			p:     &process{},
+			child: func(*exec.Cmd, func()) error { return nil },
+			want:  huprt.ErrChildExitedSentinel,
+		},
+		{
+			name: "timeout",
+			p:    &process{},
+			child: func(*exec.Cmd, func()) error {
+				time.Sleep(time.Second)
+				return nil
+			},
+			want: huprt.ErrTimeoutSentinel,
+		},
+		{
+			name: "ready then exited",
+			p:    &process{},
+			child: func(_ *exec.Cmd, ready func()) error {
+				ready()
+				return errors.New("exited")
+			},
+			killed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &FakeHupd{Process: tt.p, Child: tt.child, Timeout: 50 * time.Millisecond}
+			err := f.Restart()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Restart() error = %v", err)
+				}
+			} else if !errors.Is(err, tt.want) {
+				t.Fatalf("Restart() error = %v; want %v", err, tt.want)
+			}
+			if killed := tt.p.killed > 0; killed != tt.killed {
+				t.Errorf("Kill called = %t; want %t", killed, tt.killed)
+			}
+			if r := f.Restarts()[0]; r.Err != err {
+				t.Errorf("Restarts()[0].Err = %v; want %v", r.Err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// firstExtraFD is the file descriptor assigned to the first of a Cmd's ExtraFiles in the new
+// process. Descriptors 0 through 2 are stdin, stdout, and stderr.
+const firstExtraFD = 3
+
+// fileListener is any net.Listener that can return a duplicate of its underlying file, such as
+// *net.TCPListener and *net.UnixListener.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// PassListener duplicates the file descriptor of l and appends it to cmd's ExtraFiles, returning
+// its index in ExtraFiles. The new process can pass that index to InheritListener to reconstruct
+// the listener. This is intended to be called from a Process's BeginRestart method.
+//
+// The listener must have a File method, as *net.TCPListener and *net.UnixListener do. The
+// duplicated file must remain open until the new process is started, so it's closed by Restart
+// afterward, or before the Process is resumed if the restart fails. Validate closes it once it
+// returns.
+func PassListener(cmd *exec.Cmd, l net.Listener) (index int, err error) {
+	fl, ok := l.(fileListener)
+	if !ok {
+		return -1, &Error{ErrPassFile, errors.New("listener does not have a File method")}
+	}
+
+	f, err := fl.File()
+	if err != nil {
+		return -1, &Error{ErrPassFile, err}
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	ownFile(cmd, f)
+	return len(cmd.ExtraFiles) - 1, nil
+}
+
+// InheritListener reconstructs a listener passed to this process by its parent using
+// PassListener. The index is the one returned by PassListener.
+func InheritListener(index int) (net.Listener, error) {
+	if index < 0 {
+		return nil, &Error{ErrInheritFile, errors.New("invalid file index " + strconv.Itoa(index))}
+	}
+
+	fd := firstExtraFD + index
+	f := os.NewFile(uintptr(fd), "huprt-listener-"+strconv.Itoa(index))
+	if f == nil {
+		return nil, &Error{ErrInheritFile, errors.New("invalid file descriptor " + strconv.Itoa(fd))}
+	}
+	// net.FileListener duplicates the descriptor, so the original can always be closed.
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, &Error{ErrInheritFile, err}
+	}
+	return l, nil
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build !unix || solaris
+
+package huprt
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenReusable is similar to net.Listen, but allows multiple processes to listen on the same
+// address. It is not supported on this platform and always returns an ErrUnsupported error.
+func ListenReusable(network, addr string) (net.Listener, error) {
+	return nil, &Error{ErrUnsupported, errors.New("ListenReusable requires SO_REUSEPORT")}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix && !solaris
+
+package huprt
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenReusable is similar to net.Listen, but sets SO_REUSEADDR and SO_REUSEPORT on the socket
+// before binding it. This allows a new process to bind the same address while the old process is
+// still listening on it, so that BeginRestart doesn't need to close its listeners before the new
+// process has started. Both processes must use ListenReusable (or otherwise set SO_REUSEPORT) for
+// this to work.
+//
+// While both processes are listening, the kernel may distribute new connections between them.
+func ListenReusable(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusableControl}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, &Error{ErrListen, err}
+	}
+	return l, nil
+}
+
+func reusableControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if serr == nil {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"testing"
+)
+
+// listenerProcess is a Resumable Process that passes its listener to the new process and closes
+// it, listening again on the same address if the restart fails.
+type listenerProcess struct {
+	l    net.Listener
+	addr string
+}
+
+func (p *listenerProcess) BeginRestart(cmd *exec.Cmd) error {
+	if _, err := PassListener(cmd, p.l); err != nil {
+		return err
+	}
+	return p.l.Close()
+}
+
+func (p *listenerProcess) ResumeAfterAbort() error {
+	l, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	p.l = l
+	return nil
+}
+
+func (p *listenerProcess) Kill() {}
+
+func TestPassListenerClosedBeforeResume(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &listenerProcess{l: l, addr: l.Addr().String()}
+	defer func() { p.l.Close() }()
+
+	h := &Hupd{
+		Process: p,
+		// Fail the restart after BeginRestart, without starting a new process.
+		InspectCmd: func(*exec.Cmd) error { return errors.New("not starting") },
+	}
+	err = h.Restart()
+	if !errors.Is(err, ErrNewProcessSentinel) || errors.Is(err, ErrResumeSentinel) {
+		t.Fatalf("Restart() error = %v; want an ErrNewProcess error after resuming", err)
+	}
+}
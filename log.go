@@ -0,0 +1,26 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+// Logger is used by Hupd to log each stage of a restart.
+type Logger interface {
+	Logf(format string, args ...interface{})
+}
+
+// LoggerFunc is an adapter to allow the use of ordinary functions, such as log.Printf, as
+// Loggers.
+type LoggerFunc func(format string, args ...interface{})
+
+// Logf calls fn(format, args...).
+func (fn LoggerFunc) Logf(format string, args ...interface{}) {
+	fn(format, args...)
+}
+
+func (h *Hupd) logf(format string, args ...interface{}) {
+	if h.Logger == nil {
+		return
+	}
+	h.Logger.Logf(format, args...)
+}
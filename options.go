@@ -0,0 +1,69 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"syscall"
+	"time"
+)
+
+// Option configures a Hupd created by New.
+type Option func(*Hupd)
+
+// New returns a new Hupd for the Process p, configured by opts. It returns an error if p is nil
+// or the resulting configuration is invalid, such as if the restart and kill signals are the same
+// or the restart argument is invalid (see the Hupd's ReservedArgs field). Programs with nothing to
+// release can pass DefaultProcess.
+//
+// New is an alternative to configuring a Hupd by setting its fields directly, which remains
+// supported.
+func New(p Process, opts ...Option) (*Hupd, error) {
+	if p == nil {
+		return nil, &Error{ErrNoProcess, nil}
+	}
+
+	h := &Hupd{Process: p}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.signalConflict() {
+		return nil, &Error{ErrSignalConflict, nil}
+	}
+	if err := h.validateRestartArg(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// WithTimeout sets the Hupd's Timeout.
+func WithTimeout(d time.Duration) Option {
+	return func(h *Hupd) { h.Timeout = d }
+}
+
+// WithRestartArg sets the Hupd's RestartArg.
+func WithRestartArg(arg string) Option {
+	return func(h *Hupd) { h.RestartArg = arg }
+}
+
+// WithRestartSignal sets the Hupd's RestartSignal.
+func WithRestartSignal(sig syscall.Signal) Option {
+	return func(h *Hupd) { h.RestartSignal = sig }
+}
+
+// WithKillSignal sets the Hupd's KillSignal.
+func WithKillSignal(sig syscall.Signal) Option {
+	return func(h *Hupd) { h.KillSignal = sig }
+}
+
+// WithReadySignal sets the Hupd's ReadySignal.
+func WithReadySignal(sig syscall.Signal) Option {
+	return func(h *Hupd) { h.ReadySignal = sig }
+}
+
+// WithLogger sets the Hupd's Logger.
+func WithLogger(l Logger) Option {
+	return func(h *Hupd) { h.Logger = l }
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// prefixWriter writes each line written to it to w with a prefix.
+type prefixWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+// newPrefixWriter returns a prefixWriter that tags lines written to w with the given generation.
+func newPrefixWriter(w io.Writer, gen int) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(fmt.Sprintf("[gen %d] ", gen))}
+}
+
+// Write writes p to the underlying writer, inserting the prefix at the start of each line. Each
+// line is written in a single call to the underlying writer so that it isn't interleaved with
+// other output.
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	n := len(p)
+	var buf []byte
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+		}
+		p = p[len(line):]
+
+		buf = buf[:0]
+		if !pw.midLine {
+			buf = append(buf, pw.prefix...)
+		}
+		buf = append(buf, line...)
+		pw.midLine = line[len(line)-1] != '\n'
+
+		if _, err := pw.w.Write(buf); err != nil {
+			return n - len(p) - len(line), err
+		}
+	}
+	return n, nil
+}
+
+// flusher is implemented by buffered writers, such as *bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// syncer is implemented by writers backed by a file, such as *os.File.
+type syncer interface {
+	Sync() error
+}
+
+// syncOutput flushes and syncs the Hupd's Stdout and Stderr, or this process's standard output and
+// standard error if they're nil. Errors are logged but otherwise ignored, since syncing fails for
+// some files, such as terminals and pipes.
+func (h *Hupd) syncOutput() {
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if h.Stdout != nil {
+		stdout = h.Stdout
+	}
+	if h.Stderr != nil {
+		stderr = h.Stderr
+	}
+
+	for _, w := range []io.Writer{stdout, stderr} {
+		if f, ok := w.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				h.logf("huprt: error flushing output: %v", err)
+			}
+		}
+		if s, ok := w.(syncer); ok {
+			if err := s.Sync(); err != nil {
+				h.logf("huprt: error syncing output: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writePIDFile atomically writes this process's PID to the Hupd's PIDFile, if set, by writing it to
+// a temporary file in the same directory and renaming it over PIDFile. Any existing file, such as
+// one left by the parent process or by a previous run that didn't exit cleanly, is replaced.
+func (h *Hupd) writePIDFile() error {
+	if h.PIDFile == "" {
+		return nil
+	}
+
+	dir, base := filepath.Split(h.PIDFile)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".tmp-*")
+	if err != nil {
+		return &Error{ErrPIDFile, err}
+	}
+	_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), h.PIDFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return &Error{ErrPIDFile, err}
+	}
+	return nil
+}
+
+// RemovePIDFile removes the Hupd's PIDFile if it still holds this process's PID. It should be
+// called when the program exits cleanly for a reason other than a restart, such as at the end of
+// main. The file isn't removed if it holds another PID, so an old process that exits after a
+// restart doesn't remove the new process's PID file. It does nothing if PIDFile isn't set or the
+// file doesn't exist. Run calls RemovePIDFile when its context is canceled.
+func (h *Hupd) RemovePIDFile() error {
+	if h.PIDFile == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(h.PIDFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return &Error{ErrPIDFile, err}
+	}
+	if string(bytes.TrimSpace(b)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	if err := os.Remove(h.PIDFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &Error{ErrPIDFile, err}
+	}
+	return nil
+}
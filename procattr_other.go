@@ -0,0 +1,24 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package huprt
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// setProcAttr returns an ErrUnsupported error if the Hupd's NewProcessGroup or Detach field is
+// set, since process groups and sessions are only supported on Unix.
+func (h *Hupd) setProcAttr(cmd *exec.Cmd) error {
+	if h.NewProcessGroup {
+		return &Error{ErrUnsupported, errors.New("NewProcessGroup requires Unix")}
+	}
+	if h.Detach {
+		return &Error{ErrUnsupported, errors.New("Detach requires Unix")}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcAttr configures cmd's SysProcAttr according to the Hupd's NewProcessGroup and Detach
+// fields.
+func (h *Hupd) setProcAttr(cmd *exec.Cmd) error {
+	if !h.NewProcessGroup && !h.Detach {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = new(syscall.SysProcAttr)
+	}
+
+	// A session leader can't change its process group, so only one of these may be set. Detach
+	// takes precedence, including over a Setpgid copied from the Hupd's SysProcAttr.
+	if h.Detach {
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setpgid = false
+		cmd.SysProcAttr.Pgid = 0
+	} else {
+		cmd.SysProcAttr.Setpgid = true
+		cmd.SysProcAttr.Pgid = 0
+	}
+	return nil
+}
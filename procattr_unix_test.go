@@ -0,0 +1,28 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestDetachOverridesSetpgid(t *testing.T) {
+	h := &Hupd{Detach: true, SysProcAttr: &syscall.SysProcAttr{Setpgid: true, Pgid: 42}}
+	cmd := h.buildCmd()
+	if err := h.setProcAttr(cmd); err != nil {
+		t.Fatalf("setProcAttr() error = %v", err)
+	}
+
+	attr := cmd.SysProcAttr
+	if !attr.Setsid || attr.Setpgid || attr.Pgid != 0 {
+		t.Errorf("SysProcAttr = %+v; want Setsid without Setpgid", *attr)
+	}
+	if !h.SysProcAttr.Setpgid {
+		t.Error("setProcAttr modified the Hupd's SysProcAttr")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// readyFDEnvKey is the environment variable used to pass the file descriptor of the readiness
+// pipe's write end to the new process.
+const readyFDEnvKey = "HUPRT_READY_FD"
+
+// readyOnStartEnvKey is the environment variable telling the new process's Start to report that
+// it's ready through the readiness pipe, rather than by signaling its parent. It's set to "1" when
+// the parent's VerifySender field is set.
+const readyOnStartEnvKey = "HUPRT_READY_ON_START"
+
+// readyPipe creates a readiness pipe and passes its write end to cmd as one of its ExtraFiles.
+// The write end must be closed by the caller once the new process has been started (or failed to
+// start).
+func readyPipe(cmd *exec.Cmd) (r, w *os.File, err error) {
+	r, w, err = os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	fd := firstExtraFD + len(cmd.ExtraFiles) - 1
+
+	setCmdEnv(cmd, readyFDEnvKey, strconv.Itoa(fd))
+
+	return r, w, nil
+}
+
+// waitReady returns a channel that receives the status reported by the new process once it's
+// ready: a byte is read from r, optionally followed by a status written by ReportReady. If r is
+// closed or returns an error before the first byte, the channel never receives.
+func waitReady(r *os.File) <-chan map[string]string {
+	ready := make(chan map[string]string, 1)
+	go func() {
+		br := bufio.NewReader(r)
+		if _, err := br.ReadByte(); err != nil {
+			return
+		}
+
+		// SignalReady closes the pipe after the first byte, so this only blocks until the rest of
+		// a status is read.
+		var status map[string]string
+		if line, err := br.ReadBytes('\n'); err == nil {
+			json.Unmarshal(line, &status)
+		}
+		ready <- status
+	}()
+	return ready
+}
+
+// SignalReady tells the parent process that this process is ready and that the parent should
+// exit. This is only used if the Hupd's ReadyPipe field is set, in which case it replaces the
+// KillSignal sent by Start. It returns an ErrReady error if this process was not given a
+// readiness pipe or writing to it fails.
+//
+// SignalReady closes the readiness pipe, so only the first call has any effect.
+func SignalReady() error {
+	return writeReady(nil)
+}
+
+// ReportReady is the same as SignalReady, except that it also passes status to the parent
+// process, such as this process's version or the ports it's listening on. The parent passes it to
+// its Hupd's OnReady hook. Like SignalReady, it requires a readiness pipe; without one, the signal
+// handshake is used and ReportReady returns an ErrReady error, so the status can't be reported.
+func ReportReady(status map[string]string) error {
+	msg, err := json.Marshal(status)
+	if err != nil {
+		return &Error{ErrReady, err}
+	}
+	return writeReady(append(msg, '\n'))
+}
+
+// writeReady writes the readiness byte, followed by status, to the readiness pipe and closes it.
+func writeReady(status []byte) error {
+	fdstr, ok := os.LookupEnv(readyFDEnvKey)
+	if !ok {
+		return &Error{ErrReady, errors.New("no readiness pipe")}
+	}
+	os.Unsetenv(readyFDEnvKey)
+
+	fd, err := strconv.Atoi(fdstr)
+	if err != nil || fd < firstExtraFD {
+		return &Error{ErrReady, errors.New("invalid readiness pipe descriptor " + strconv.Quote(fdstr))}
+	}
+
+	f := os.NewFile(uintptr(fd), "huprt-ready")
+	defer f.Close()
+	if _, err := f.Write(append([]byte{1}, status...)); err != nil {
+		return &Error{ErrReady, err}
+	}
+	return nil
+}
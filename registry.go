@@ -0,0 +1,118 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	registryMu sync.Mutex
+	// listeners holds the listeners registered with RegisterListener, by name.
+	listeners = map[string]net.Listener{}
+	// claimed holds the names of the listeners claimed with ClaimListener.
+	claimed = map[string]bool{}
+)
+
+// RegisterListener registers l under the given name so that it's passed to the new process on
+// every restart, where it can be reconstructed with ClaimListener. This removes the need to call
+// PassListener from BeginRestart and keep track of file descriptors. Registering a listener under
+// a name that's already registered replaces it. The name must not contain a comma.
+//
+// Since the listener is passed to the new process, BeginRestart should not close it. If it's
+// closed anyway, the restart fails with an ErrPassFile error. Use UnregisterListener to stop
+// passing a listener.
+func RegisterListener(name string, l net.Listener) error {
+	if strings.Contains(name, ",") {
+		return &Error{ErrPassFile, fmt.Errorf("listener name %q contains a comma", name)}
+	}
+	if _, ok := l.(fileListener); !ok {
+		return &Error{ErrPassFile, errors.New("listener does not have a File method")}
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	listeners[name] = l
+	return nil
+}
+
+// UnregisterListener removes the listener registered under name, if any, so that it's no longer
+// passed to new processes.
+func UnregisterListener(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(listeners, name)
+}
+
+// passListeners passes each registered listener to cmd using PassFile, in order of name. It
+// returns the duplicated files, which must be closed once the new process has been started.
+func passListeners(cmd *exec.Cmd) ([]*os.File, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		f, err := listeners[name].(fileListener).File()
+		if err == nil {
+			_, err = PassFile(cmd, name, f)
+		}
+		if err != nil {
+			closeFiles(files)
+			if f != nil {
+				f.Close()
+			}
+			return nil, &Error{ErrPassFile, fmt.Errorf("listener %q: %w", name, err)}
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// closeFiles closes each of files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// ClaimListener reconstructs the listener registered under name with RegisterListener in the
+// parent process. Each listener can only be claimed once; later calls return an ErrInheritFile
+// error, as do calls for names that weren't passed to this process.
+//
+// Unlike InheritedFiles, ClaimListener only opens the descriptor for the named listener, so it
+// doesn't interfere with other inherited files.
+func ClaimListener(name string) (net.Listener, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if claimed[name] {
+		return nil, &Error{ErrInheritFile, fmt.Errorf("listener %q already claimed", name)}
+	}
+
+	fd, err := InheritedFD(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := InheritListener(fd - firstExtraFD)
+	if err != nil {
+		return nil, err
+	}
+	claimed[name] = true
+	return l, nil
+}
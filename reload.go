@@ -0,0 +1,58 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"fmt"
+	"os"
+)
+
+// reload decides whether a restart signal should reload the process instead of restarting it, as
+// described by the Hupd's ReloadFunc field, and calls ReloadFunc if so. It reports whether the
+// process was reloaded; if not, the caller should restart it. Any error from ReloadFunc is returned
+// as an ErrReload error. If ReloadFunc panics, the panic is recovered and returned as an ErrPanic
+// error.
+func (h *Hupd) reload() (reloaded bool, err error) {
+	if h.ReloadFunc == nil {
+		return false, nil
+	}
+	if h.RestartIfBinaryChanged && h.binaryChanged() {
+		h.logf("huprt: binary changed, restarting instead of reloading")
+		return false, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// The process may be partly reloaded, so don't restart it.
+			reloaded = true
+			err = &Error{ErrPanic, fmt.Errorf("ReloadFunc panicked: %v", r)}
+		}
+	}()
+
+	h.logf("huprt: reloading process")
+	if err := h.ReloadFunc(); err != nil {
+		h.logf("huprt: reload failed: %v", err)
+		return true, &Error{ErrReload, err}
+	}
+	return true, nil
+}
+
+// binaryChanged reports whether the executable the new process would be started from differs from
+// the one it was when Start was called, either because it was replaced or modified. If Start hasn't
+// been called or the executable can't be found, it reports false.
+func (h *Hupd) binaryChanged() bool {
+	h.mu.Lock()
+	orig := h.binaryInfo
+	h.mu.Unlock()
+	if orig == nil {
+		return false
+	}
+
+	cur, err := os.Stat(h.binary())
+	if err != nil {
+		return false
+	}
+	return !os.SameFile(orig, cur) || !cur.ModTime().Equal(orig.ModTime()) || cur.Size() != orig.Size()
+}
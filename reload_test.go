@@ -0,0 +1,54 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+// countingProcess is a Process that counts calls to BeginRestart and fails them, so no new process
+// is started.
+type countingProcess struct {
+	began int
+}
+
+func (p *countingProcess) BeginRestart(*exec.Cmd) error {
+	p.began++
+	return errors.New("not restarting")
+}
+
+func (p *countingProcess) Kill() {}
+
+func TestReloadPanic(t *testing.T) {
+	p := &countingProcess{}
+	h := &Hupd{Process: p, ReloadFunc: func() error { panic("bad config") }}
+
+	ch := make(chan os.Signal, 1)
+	ch <- syscall.SIGHUP
+	if err := h.NotifyRestartChan(ch); !errors.Is(err, ErrPanicSentinel) {
+		t.Errorf("NotifyRestartChan() error = %v; want an ErrPanic error", err)
+	}
+	if p.began != 0 {
+		t.Errorf("BeginRestart called %d times after ReloadFunc panicked; want 0", p.began)
+	}
+}
+
+func TestReloadError(t *testing.T) {
+	p := &countingProcess{}
+	h := &Hupd{Process: p, ReloadFunc: func() error { return errors.New("bad config") }}
+
+	ch := make(chan os.Signal, 1)
+	ch <- syscall.SIGHUP
+	if err := h.NotifyRestartChan(ch); !errors.Is(err, ErrReloadSentinel) {
+		t.Errorf("NotifyRestartChan() error = %v; want an ErrReload error", err)
+	}
+	if p.began != 0 {
+		t.Errorf("BeginRestart called %d times after a reload; want 0", p.began)
+	}
+}
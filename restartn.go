@@ -0,0 +1,258 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// childIndexEnvKey is the environment variable used to pass each new process started by RestartN
+// its index.
+const childIndexEnvKey = "HUPRT_CHILD_INDEX"
+
+// ChildIndex returns the index passed to this process by a parent that restarted using RestartN,
+// from 0 to n-1. If this process wasn't started by RestartN, it returns -1.
+func ChildIndex() int {
+	n, err := strconv.Atoi(os.Getenv(childIndexEnvKey))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// RestartN restarts this process as n new processes, such as the workers of a prefork server. It
+// waits for all of them to report that they're ready before calling the Process's Kill method
+// once. Each new process is passed its index, which it can read with ChildIndex.
+//
+// The Process's BeginRestart method (or Prepare, if it implements PrepareProcess) is called once,
+// and the Cmd it configures is used as a template for all n processes, so any files passed in its
+// ExtraFiles are shared by them. Since signals sent by several processes at once can't be told
+// apart, each new process reports that it's ready through a readiness pipe, as with ReadyPipe.
+// Start does so automatically in a process started by RestartN, unless its Hupd's ReadyPipe field
+// is set, in which case it must call SignalReady itself.
+//
+// Otherwise, RestartN behaves the same as Restart. If any of the new processes fails to start,
+// exits, or doesn't report that it's ready before the Timeout elapses, the restart fails. If one
+// fails to start, those already started are killed. Otherwise, if the Hupd's KillChildOnFailure
+// field is set, or a CancelSignal was received, all of the new processes are killed. The Hupd's
+// InspectCmd hook is called once, with the template Cmd, and ForwardSignals are forwarded to every
+// new process.
+//
+// The Hupd's SnapshotState hook isn't supported, since its state can only be restored once. If it's
+// set, RestartN returns an ErrUnsupported error before calling BeginRestart.
+func (h *Hupd) RestartN(n int) error {
+	if n < 1 {
+		return &Error{ErrNewProcess, fmt.Errorf("invalid number of processes: %d", n)}
+	}
+
+	if !atomic.CompareAndSwapInt32(&h.restarting, 0, 1) {
+		return &Error{ErrRestartInProgress, nil}
+	}
+	defer atomic.StoreInt32(&h.restarting, 0)
+
+	if err := h.limitRestart(); err != nil {
+		h.logf("huprt: restart refused: %v", err)
+		return err
+	}
+
+	h.restarts.Add(1)
+	ctx, cancel := h.withDeadline(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	err := deadlineErr(ctx, h.restartN(ctx, n))
+	if err != nil {
+		h.logf("huprt: restart failed: %v", err)
+	}
+	if h.OnRestartComplete != nil {
+		h.OnRestartComplete(time.Since(start), err)
+	}
+	return err
+}
+
+// child is one of the new processes started by RestartN.
+type child struct {
+	cmd    *exec.Cmd
+	ready  <-chan map[string]string
+	exited chan error
+}
+
+func (h *Hupd) restartN(ctx context.Context, n int) (err error) {
+	if h.process() == nil {
+		return &Error{ErrNoProcess, nil}
+	}
+	if err := h.validateRestartArg(); err != nil {
+		return err
+	}
+	if h.SnapshotState != nil {
+		return &Error{ErrUnsupported, errors.New("RestartN does not support SnapshotState")}
+	}
+
+	tmpl := h.buildCmd()
+	if err := h.setProcAttr(tmpl); err != nil {
+		return err
+	}
+	if err := validateCmd(tmpl); err != nil {
+		return &Error{ErrNewProcess, err}
+	}
+
+	h.logf("huprt: beginning restart of %d processes: %q", n, tmpl.Args)
+	prep, err := h.beginRestart(ctx, tmpl)
+	defer closeOwnedFiles(tmpl)
+	if err != nil {
+		return err
+	}
+
+	handedOff := false
+	defer func() {
+		if err == nil || handedOff {
+			return
+		}
+		// Close the duplicates of any passed listeners first, so the Process can listen again.
+		closeOwnedFiles(tmpl)
+		if prep != nil && !prep.done {
+			h.logf("huprt: rolling back process after failed restart")
+			prep.rollback()
+			return
+		}
+		err = h.resume(err)
+	}()
+
+	if err := validateCmd(tmpl); err != nil {
+		return &Error{ErrNewProcess, err}
+	}
+
+	passed, err := passListeners(tmpl)
+	if err != nil {
+		return err
+	}
+	defer closeFiles(passed)
+
+	if h.InspectCmd != nil {
+		if err := h.InspectCmd(tmpl); err != nil {
+			return &Error{ErrNewProcess, err}
+		}
+	}
+
+	setFDEnv(tmpl)
+
+	var children []*child
+	killChildren := h.KillChildOnFailure
+	defer func() {
+		if err == nil || handedOff || !killChildren {
+			return
+		}
+		for _, c := range children {
+			h.logf("huprt: killing new process %d after failed restart", c.cmd.Process.Pid)
+			if kerr := c.cmd.Process.Kill(); kerr == nil {
+				<-c.exited
+			}
+		}
+	}()
+
+	var stops []func()
+	stopForwarding := func() {
+		for _, stop := range stops {
+			stop()
+		}
+		stops = nil
+	}
+	defer stopForwarding()
+
+	for i := 0; i < n; i++ {
+		c, err := h.startChild(tmpl, i)
+		if err != nil {
+			// A partly started set of processes can't take over, and those that did start hold
+			// the passed files, so they're always killed before this process is resumed.
+			killChildren = true
+			return err
+		}
+		children = append(children, c)
+		stops = append(stops, h.forwardSignals(c.cmd.Process))
+	}
+	prep.commit()
+
+	cancelSig, stopCancel := h.notifyCancel()
+	defer stopCancel()
+
+	timeout := h.timeout()
+	for _, c := range children {
+		select {
+		case status := <-c.ready:
+			if h.OnReady != nil {
+				h.OnReady(status)
+			}
+		case <-timeout:
+			h.dumpStacks()
+			return &Error{ErrTimeout, &ChildError{PID: c.cmd.Process.Pid}}
+		case <-ctx.Done():
+			return &Error{ErrCanceled, ctx.Err()}
+		case s := <-cancelSig:
+			// As with Restart, a cancel signal means the operator wants everything to stop.
+			killChildren = true
+			return &Error{ErrCanceled, fmt.Errorf("received %v", s)}
+		case werr := <-c.exited:
+			// Keep the result for the deferred cleanup.
+			c.exited <- werr
+			return &Error{ErrChildExited, &ChildError{c.cmd.Process.Pid, werr}}
+		}
+	}
+	stopForwarding()
+	h.logf("huprt: all %d new processes are ready", n)
+
+	if h.HealthCheck != nil {
+		if err := h.HealthCheck(); err != nil {
+			return &Error{ErrUnhealthy, err}
+		}
+	}
+
+	handedOff = true
+	return h.kill()
+}
+
+// startChild starts the new process with the given index, configured from tmpl.
+func (h *Hupd) startChild(tmpl *exec.Cmd, index int) (*child, error) {
+	cmd := cloneCmd(tmpl)
+	cmd.ExtraFiles = append([]*os.File(nil), tmpl.ExtraFiles...)
+	setCmdEnv(cmd, childIndexEnvKey, strconv.Itoa(index))
+
+	r, w, err := readyPipe(cmd)
+	if err != nil {
+		return nil, &Error{ErrNewProcess, err}
+	}
+
+	cmd, err = h.startCmd(cmd)
+	// Only the new process needs the write end of the pipe.
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, &Error{ErrNewProcess, err}
+	}
+
+	h.logf("huprt: started new process %d (index %d)", cmd.Process.Pid, index)
+	if h.OnSpawn != nil {
+		h.OnSpawn(cmd.Process.Pid)
+	}
+
+	c := &child{cmd: cmd, ready: waitReady(r), exited: make(chan error, 1)}
+	go func() {
+		err := cmd.Wait()
+		// Closing the read end of the pipe stops waitReady's goroutine if the process never wrote
+		// to it.
+		r.Close()
+		c.exited <- err
+		if h.OnChildExit != nil {
+			h.OnChildExit(cmd.ProcessState)
+		}
+	}()
+	return c, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRestartNKillsStartedOnSpawnFailure(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "child")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexec sleep 30\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var spawned []int
+	exited := make(chan int, 2)
+	h := &Hupd{
+		Process: NewProcess(nil, func() { t.Error("Kill called after a failed restart") }),
+		Binary:  bin,
+		Timeout: 10 * time.Second,
+		OnSpawn: func(pid int) {
+			mu.Lock()
+			spawned = append(spawned, pid)
+			mu.Unlock()
+			// Make starting the next process fail. The shell can still read the script.
+			os.Chmod(bin, 0600)
+		},
+		OnChildExit: func(ps *os.ProcessState) { exited <- ps.Pid() },
+	}
+
+	if err := h.RestartN(2); !errors.Is(err, ErrNewProcessSentinel) {
+		t.Fatalf("RestartN(2) error = %v; want an ErrNewProcess error", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spawned) != 1 {
+		t.Fatalf("started %d processes; want 1", len(spawned))
+	}
+	select {
+	case pid := <-exited:
+		if pid != spawned[0] {
+			t.Errorf("process %d exited; want %d", pid, spawned[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("process %d was left running", spawned[0])
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"context"
+	"errors"
+	"os/signal"
+)
+
+// Run is a convenience for the usual main loop of a program using huprt. It calls StartAuto, then
+// restarts the process each time the restart signal is received, until ctx is canceled or a fatal
+// error occurs. The program must still provide a Process (or rely on DefaultProcess) to release
+// its resources in BeginRestart and exit in Kill, and should cancel ctx when it shuts down for
+// other reasons.
+//
+// A failed restart that the process recovered from, such as one where the new process exited
+// before completing the handshake, isn't fatal: Run logs it and waits for the next signal. Errors
+// that leave the process unusable are returned, such as errors from StartAuto, ErrResume errors,
+// errors from the Process's Kill method, and timeouts waiting for BeginRestart to return. A
+// restart that fails after BeginRestart has returned is also fatal unless the Process implements
+// Resumable or PrepareProcess, or is DefaultProcess, since it may have released its resources
+// with no way to reacquire them. The
+// Hupd's CoalesceWindow applies as it does for NotifyRestartLoop.
+//
+// If the Hupd's ReloadFunc field is set, the restart signal may reload the process instead, as
+// described by that field. A failed reload isn't fatal either, but a ReloadFunc that panics is.
+//
+// Run returns nil once ctx is canceled, or once a restart succeeds and the Process's Kill method
+// returns without exiting the program. If ctx is canceled, Run removes the Hupd's PIDFile with
+// RemovePIDFile and returns its error, if any. If the Hupd is stopped, it returns an ErrStopped
+// error.
+func (h *Hupd) Run(ctx context.Context) error {
+	if err := h.StartAuto(); err != nil {
+		return err
+	}
+
+	hup, err := h.notifyRestartSignal()
+	if err != nil {
+		return err
+	}
+	defer signal.Stop(hup)
+
+	done := h.done()
+	for {
+		select {
+		case <-hup:
+		case <-ctx.Done():
+			return h.RemovePIDFile()
+		case <-done:
+			return &Error{ErrStopped, nil}
+		}
+		if err := h.coalesce(hup, done); err != nil {
+			return err
+		}
+
+		if reloaded, err := h.reload(); reloaded {
+			if isFatal(err) {
+				return err
+			}
+			continue
+		}
+
+		var res RestartResult
+		_, err := h.restartContext(ctx, &res)
+		switch {
+		case err == nil:
+			return nil
+		case ctx.Err() != nil:
+			return h.RemovePIDFile()
+		case isFatal(err), res.released && !h.recoverable():
+			return err
+		}
+	}
+}
+
+// isFatal reports whether err, returned by a restart, leaves the process unable to continue,
+// either because it couldn't reacquire its resources or because the new process took over. This
+// includes a restart that timed out or was canceled while waiting for BeginRestart, since the
+// Process may have released its resources and isn't resumed.
+func isFatal(err error) bool {
+	return errors.Is(err, errBeginRestartAbandoned) ||
+		errors.Is(err, ErrResumeSentinel) ||
+		errors.Is(err, ErrKillSentinel) ||
+		errors.Is(err, ErrPanicSentinel) ||
+		errors.Is(err, ErrStoppedSentinel)
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBeginRestartTimeoutIsFatal(t *testing.T) {
+	clock := newFakeClock()
+	p := &blockingProcess{release: make(chan struct{})}
+	defer close(p.release)
+	h := &Hupd{Process: p, Timeout: time.Hour, Clock: clock}
+
+	errc := make(chan error, 1)
+	go func() { errc <- h.Restart() }()
+	clock.fire(t)
+
+	if err := <-errc; !isFatal(err) {
+		t.Errorf("isFatal(%v) = false; want true", err)
+	}
+}
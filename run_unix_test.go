@@ -0,0 +1,87 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+//go:build unix
+
+package huprt
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// resumableProcess is a Resumable Process that reports each call to ResumeAfterAbort on resumed.
+type resumableProcess struct {
+	resumed chan struct{}
+}
+
+func (p *resumableProcess) BeginRestart(*exec.Cmd) error { return nil }
+func (p *resumableProcess) Kill()                        {}
+
+func (p *resumableProcess) ResumeAfterAbort() error {
+	p.resumed <- struct{}{}
+	return nil
+}
+
+// runRestartFails runs h with Run, failing each restart after BeginRestart returns, and sends it a
+// restart signal. It returns the channel Run's result is sent on and a function that cancels it.
+func runRestartFails(t *testing.T, h *Hupd) (<-chan error, context.CancelFunc) {
+	t.Helper()
+	h.InspectCmd = func(*exec.Cmd) error { return errors.New("not starting") }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	errc := make(chan error, 1)
+	go func() { errc <- h.Run(ctx) }()
+
+	// Give Run time to start handling the restart signal.
+	time.Sleep(50 * time.Millisecond)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	return errc, cancel
+}
+
+func TestRunFatalWithoutResume(t *testing.T) {
+	h := &Hupd{Process: NewProcess(nil, nil)}
+	errc, _ := runRestartFails(t, h)
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, ErrNewProcessSentinel) {
+			t.Errorf("Run() error = %v; want an ErrNewProcess error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept waiting after a restart left the process without its resources")
+	}
+}
+
+func TestRunContinuesAfterResume(t *testing.T) {
+	p := &resumableProcess{resumed: make(chan struct{}, 1)}
+	h := &Hupd{Process: p}
+	errc, cancel := runRestartFails(t, h)
+
+	select {
+	case <-p.resumed:
+	case err := <-errc:
+		t.Fatalf("Run() returned %v before resuming", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process wasn't resumed")
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("Run() returned %v after the process was resumed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Errorf("Run() error = %v after cancel; want nil", err)
+	}
+}
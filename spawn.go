@@ -0,0 +1,56 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"errors"
+	"math/rand"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// startCmd starts cmd, retrying up to the Hupd's SpawnRetries times if starting it fails with a
+// temporary error. Since an exec.Cmd can't be reused once Start has been called, each retry uses a
+// copy of cmd. The Cmd that was started (or that failed last) is returned.
+func (h *Hupd) startCmd(cmd *exec.Cmd) (*exec.Cmd, error) {
+	delay := h.SpawnRetryDelay
+	for attempt := 0; ; attempt++ {
+		next := cloneCmd(cmd)
+		err := cmd.Start()
+		if err == nil || attempt >= h.SpawnRetries || !retryableSpawnError(err) {
+			return cmd, err
+		}
+
+		h.logf("huprt: starting new process failed, retrying in %v: %v", delay, err)
+		if delay > 0 {
+			// Add up to 50% jitter so that processes restarted together don't retry in lockstep.
+			time.Sleep(delay + time.Duration(rand.Int63n(int64(delay)/2+1)))
+			delay *= 2
+		}
+		cmd = next
+	}
+}
+
+// retryableSpawnError returns whether err, returned by exec.Cmd's Start method, is a temporary
+// failure to fork that may succeed if retried.
+func retryableSpawnError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN)
+}
+
+// cloneCmd returns a new, unstarted Cmd with the same configuration as cmd.
+func cloneCmd(cmd *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path:        cmd.Path,
+		Args:        cmd.Args,
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		Stdin:       cmd.Stdin,
+		Stdout:      cmd.Stdout,
+		Stderr:      cmd.Stderr,
+		ExtraFiles:  cmd.ExtraFiles,
+		SysProcAttr: cmd.SysProcAttr,
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"os"
+	"os/exec"
+)
+
+// stateFileEnvKey is the environment variable holding the path of the file containing the state
+// passed to the new process by SnapshotState.
+const stateFileEnvKey = "HUPRT_STATE_FILE"
+
+// passState calls the Hupd's SnapshotState hook, if set, and writes the state it returns to a
+// temporary file whose path is passed to cmd in its environment. It returns the path of the file,
+// which must be removed if the new process isn't started, or an empty string if there's no state.
+func (h *Hupd) passState(cmd *exec.Cmd) (string, error) {
+	if h.SnapshotState == nil {
+		return "", nil
+	}
+
+	state, err := h.SnapshotState()
+	if err != nil {
+		return "", &Error{ErrState, err}
+	}
+
+	// CreateTemp creates the file with mode 0600, so only this user can read the state.
+	f, err := os.CreateTemp("", "huprt-state-*")
+	if err != nil {
+		return "", &Error{ErrState, err}
+	}
+	_, err = f.Write(state)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", &Error{ErrState, err}
+	}
+
+	setCmdEnv(cmd, stateFileEnvKey, f.Name())
+	return f.Name(), nil
+}
+
+// RestoreState returns the state passed to this process by its parent's SnapshotState hook and
+// removes the file it was passed in, so it can only be restored once. If no state was passed, it
+// returns nil and no error. Any error reading or removing the file is returned as an ErrState
+// error.
+func RestoreState() ([]byte, error) {
+	path := os.Getenv(stateFileEnvKey)
+	if path == "" {
+		return nil, nil
+	}
+	// Don't let processes started by this one try to restore the same state.
+	os.Unsetenv(stateFileEnvKey)
+
+	state, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &Error{ErrState, err}
+	}
+	if err := os.Remove(path); err != nil {
+		return state, &Error{ErrState, err}
+	}
+	return state, nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2015 Noel Cower. All rights reserved.
+// Use of this source code is governed by a simplified
+// BSD license that can be found in the LICENSE file.
+
+package huprt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Resumable is an optional interface that a Process can implement to undo the effects of its
+// BeginRestart method. ResumeAfterAbort is called after BeginRestart has succeeded but the restart
+// can't continue (for example, because the new process couldn't be started), and must reacquire
+// any resources released by BeginRestart so that the process can keep running. Without it, a
+// failed restart leaves the process without its resources.
+type Resumable interface {
+	ResumeAfterAbort() error
+}
+
+// Validate performs a dry run of a restart without starting a new process. It calls the Process's
+// BeginRestart method, checks the resulting Cmd for obvious problems (such as an empty or
+// non-executable Path), and then calls ResumeAfterAbort to reacquire any released resources.
+//
+// Since BeginRestart releases resources, the Process must implement Resumable. If it doesn't, an
+// ErrNotResumable error is returned without calling BeginRestart. A Process implementing
+// PrepareProcess is instead prepared and then rolled back. If the Cmd is invalid, an
+// ErrNewProcess error is returned after resuming the Process.
+//
+// Validate is not free of side effects: between BeginRestart and ResumeAfterAbort, the process
+// does not hold its critical resources (for example, it may not be listening on its sockets). If
+// ResumeAfterAbort fails, an ErrResume error is returned and the process is likely unusable. It
+// should only be used where that risk is acceptable, such as during testing or startup.
+func (h *Hupd) Validate() error {
+	if h.process() == nil {
+		return &Error{ErrNoProcess, nil}
+	}
+	resumable, ok := h.process().(Resumable)
+	if _, prepares := h.process().(PrepareProcess); !ok && !prepares {
+		return &Error{ErrNotResumable, nil}
+	}
+
+	if !atomic.CompareAndSwapInt32(&h.restarting, 0, 1) {
+		return &Error{ErrRestartInProgress, nil}
+	}
+	defer atomic.StoreInt32(&h.restarting, 0)
+
+	cmd := h.buildCmd()
+	prep, err := h.beginRestart(context.Background(), cmd)
+	defer closeOwnedFiles(cmd)
+	if err != nil {
+		return err
+	}
+
+	verr := validateCmd(cmd)
+	// Close the duplicates of any passed listeners first, so the Process can listen again.
+	closeOwnedFiles(cmd)
+	if prep != nil {
+		prep.rollback()
+	} else if err := resumable.ResumeAfterAbort(); err != nil {
+		return &Error{ErrResume, err}
+	}
+	if verr != nil {
+		return &Error{ErrNewProcess, verr}
+	}
+	return nil
+}
+
+// validateCmd checks that cmd's Path refers to an executable file. It doesn't guarantee that cmd
+// can be started, but it catches simple configuration mistakes before attempting to start it.
+func validateCmd(cmd *exec.Cmd) error {
+	if cmd.Path == "" {
+		return errors.New("cmd.Path is empty")
+	}
+
+	path := cmd.Path
+	if !filepath.IsAbs(path) && cmd.Dir != "" {
+		path = filepath.Join(cmd.Dir, path)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}